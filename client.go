@@ -4,12 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/nethack42/go-sftp/sshfxp"
+	"golang.org/x/net/context"
 )
 
 type Client struct {
@@ -19,15 +22,67 @@ type Client struct {
 	incoming chan sshfxp.Packet
 	outgoing chan sshfxp.Packet
 	errch    chan error
-	ioErr    error
+
+	// done is closed once the connection failed. err holds the reason
+	done chan struct{}
+	errM sync.Mutex
+	err  error
+
+	// closing is set once Close or Shutdown has been called. inflight
+	// tracks pending requests and handles all handles opened by the client
+	stateM   sync.Mutex
+	closing  bool
+	inflight sync.WaitGroup
+	handles  map[string]struct{}
+
+	closeOnce sync.Once
+	closeErr  error
 
 	router *Router
 
-	version uint32
+	version          uint32
+	serverExtensions map[string]string
+
+	symlinkOrder  SymlinkOrder
+	renameReplace bool
+
+	log              logrus.FieldLogger
+	handshakeTimeout time.Duration
+	extensions       []struct {
+		Name string
+		Data string
+	}
+
+	// chunkSize and concurrency hold the values configured by options, zero
+	// selects them based on the server limits
+	chunkSize   int
+	concurrency int
+
+	limits    Limits
+	readSize  int
+	writeSize int
+
+	// handleSlots holds a token for every handle opened by the client if
+	// the server limits the number of open handles
+	handleSlots chan struct{}
 
 	wg sync.WaitGroup
 }
 
+// SymlinkOrder defines the order of arguments sent in SSH_FXP_SYMLINK requests
+type SymlinkOrder int
+
+const (
+	// SymlinkOpenSSH sends the target path before the link path. OpenSSH
+	// (and most servers mimicking it) swapped the arguments compared to the
+	// specification and expect this order.
+	SymlinkOpenSSH SymlinkOrder = iota
+
+	// SymlinkStandard sends the link path before the target path as defined
+	// by the specification
+	SymlinkStandard
+)
+
 type ClientConn interface {
 	OpenDir(string) (string, error)
 
@@ -37,7 +92,9 @@ type ClientConn interface {
 
 	List(string) ([]os.FileInfo, error)
 
-	Close(string) error
+	CloseHandle(string) error
+
+	Close() error
 
 	Read(string, uint64, uint32) ([]byte, error)
 
@@ -47,10 +104,12 @@ type ClientConn interface {
 
 	RmDir(string) error
 
-	FileReader(string) (io.Reader, error)
+	FileReader(string) (io.ReadCloser, error)
 
 	FileWriter(string) (io.WriteCloser, error)
 
+	OpenFile(string, int, os.FileMode) (*File, error)
+
 	Put(string, string) error
 
 	Get(string, string) error
@@ -58,11 +117,73 @@ type ClientConn interface {
 	Rename(string, string) error
 
 	Remove(string) error
+
+	RealPath(string) (string, error)
+
+	ReadLink(string) (string, error)
+
+	Symlink(string, string) error
+
+	Stat(string) (os.FileInfo, error)
+
+	Lstat(string) (os.FileInfo, error)
+
+	Fstat(string) (os.FileInfo, error)
+
+	SetAttributes(string, sshfxp.Attr) error
+
+	FSetAttributes(string, sshfxp.Attr) error
+
+	Chmod(string, os.FileMode) error
+
+	Fchmod(string, os.FileMode) error
+
+	Chown(string, int, int) error
+
+	Fchown(string, int, int) error
+
+	Chtimes(string, time.Time, time.Time) error
+
+	Fchtimes(string, time.Time, time.Time) error
+
+	Truncate(string, int64) error
+
+	Ftruncate(string, int64) error
+
+	StatVFS(string) (*StatVFS, error)
+
+	FStatVFS(string) (*StatVFS, error)
+
+	Link(string, string) error
+
+	Fsync(string) error
 }
 
 var _ ClientConn = &Client{}
 
+// NewClient creates a new SFTP client using r and w as the transport. It
+// returns nil if the handshake with the server fails.
+//
+// Deprecated: use NewClientPipe which reports the reason of a failure
 func NewClient(r io.ReadCloser, w io.WriteCloser) *Client {
+	cli, err := NewClientPipe(r, w)
+	if err != nil {
+		return nil
+	}
+
+	return cli
+}
+
+// maxResponseLength is the length of the longest packet accepted from the
+// server. The client never requests more than MaxPacketLimit bytes at once, so
+// longer packets are considered a protocol error and close the connection
+const maxResponseLength = MaxPacketLimit + packetOverhead
+
+// NewClientPipe creates a new SFTP client using r and w as the transport,
+// configured by opts, and performs the SFTP handshake. An error is returned if
+// an option is invalid or the handshake fails. In both cases r and w are
+// closed
+func NewClientPipe(r io.ReadCloser, w io.WriteCloser, opts ...ClientOption) (*Client, error) {
 	cli := &Client{
 		reader:   r,
 		writer:   w,
@@ -70,70 +191,81 @@ func NewClient(r io.ReadCloser, w io.WriteCloser) *Client {
 		outgoing: make(chan sshfxp.Packet),
 		router:   NewRouter(),
 		errch:    make(chan error, 2), // one error per goroutine
+		done:     make(chan struct{}),
+		handles:  make(map[string]struct{}),
+		log:      logrus.StandardLogger(),
+	}
+
+	for _, opt := range opts {
+		if err := opt(cli); err != nil {
+			r.Close()
+			w.Close()
+
+			return nil, fmt.Errorf("invalid option: %s", err)
+		}
 	}
 
 	cli.wg.Add(2)
 	go func(cli *Client) {
 		defer cli.wg.Done()
-		defer logrus.Infof("SFTP client writer exited")
+		defer cli.log.Debugf("SFTP client writer exited")
 
-		cli.errch <- writeConn(cli.writer, cli.outgoing)
+		cli.errch <- writeConn(cli.writer, cli.outgoing, cli.done)
 	}(cli)
 
 	go func(cli *Client) {
 		defer cli.wg.Done()
-		defer logrus.Infof("SFTP client reader exited")
+		defer cli.log.Debugf("SFTP client reader exited")
 
-		cli.errch <- readConn(cli.reader, cli.incoming)
+		cli.errch <- readConn(cli.reader, cli.incoming, cli.done, maxResponseLength)
 	}(cli)
 
 	if err := cli.DoHandshake(); err != nil {
-		logrus.Errorf("SFTP handshake failed: %s", err)
+		cli.log.Errorf("SFTP handshake failed: %s", err)
 
-		// Close outgoing
-		close(cli.outgoing)
-
-		cli.reader.Close()
-		cli.writer.Close()
+		cli.fail(err)
 
 		cli.wg.Wait()
 
-		cli.ioErr = err
-
-		return nil
+		return nil, fmt.Errorf("handshake failed: %s", err)
 	}
 
-	logrus.Infof("SFTP-handeshake complete. Using SFTP version %d", cli.version)
+	cli.log.Infof("SFTP-handeshake complete. Using SFTP version %d", cli.version)
 
 	cli.wg.Add(1)
 
 	go func(cli *Client) {
 		defer cli.wg.Done()
 
-	L:
 		for {
 			select {
 			case msg := <-cli.incoming:
 				// TODO we currently ignore any error from message handling
 				if err := cli.handleMessage(msg); err != nil {
-					logrus.Errorf("failed to handle message: %s", err)
+					cli.log.Errorf("failed to handle message: %s", err)
 				}
 
 			case err := <-cli.errch:
-				if err != nil {
-					cli.ioErr = err
-					logrus.Errorf("received error: %s", err)
+				if err == nil {
+					err = io.EOF
+				}
+
+				if cli.Err() == nil {
+					cli.log.Errorf("SFTP connection lost: %s", err)
 				}
-				logrus.Infof("received nil on errch")
-				break L
-			}
-		}
 
-		close(cli.outgoing) // will cause writer to stop if it hasn't already
+				cli.fail(&ConnectionLostError{Err: err})
+				return
 
+			case <-cli.done:
+				return
+			}
+		}
 	}(cli)
 
-	return cli
+	cli.tune()
+
+	return cli, nil
 }
 
 // Wait waits for hte cient goroutines to finish
@@ -141,19 +273,223 @@ func (cli *Client) Wait() {
 	cli.wg.Wait()
 }
 
+// Done returns a channel that is closed once the connection to the server
+// failed. Err returns the reason afterwards
+func (cli *Client) Done() <-chan struct{} {
+	return cli.done
+}
+
+// Err returns the error that terminated the connection to the server or nil
+// if the connection is still alive. Pending and new requests fail with a
+// *ConnectionLostError once the connection died
+func (cli *Client) Err() error {
+	cli.errM.Lock()
+	defer cli.errM.Unlock()
+
+	return cli.err
+}
+
+// DefaultCloseTimeout is the time Client.Close waits for pending requests to
+// complete
+var DefaultCloseTimeout = 5 * time.Second
+
+// closeHandlesTimeout is the time Shutdown waits for the server to close the
+// handles still opened by the client
+const closeHandlesTimeout = 2 * time.Second
+
+// Close closes the client. See Shutdown for details. Pending requests are
+// given DefaultCloseTimeout to complete
+func (cli *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloseTimeout)
+	defer cancel()
+
+	return cli.Shutdown(ctx)
+}
+
+// Shutdown gracefully closes the client. New requests are rejected with
+// ErrClosed while requests in flight may complete until ctx is done. Afterwards
+// all file and directory handles still opened by the client are closed, the
+// connection is torn down and the error that terminated the connection
+// earlier is returned. If the connection was alive but closing a handle
+// failed, that error is returned instead. Shutdown may be called multiple
+// times and returns the same error each time
+func (cli *Client) Shutdown(ctx context.Context) error {
+	cli.closeOnce.Do(func() {
+		cli.stateM.Lock()
+		cli.closing = true
+		cli.stateM.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			cli.inflight.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-cli.done:
+		case <-ctx.Done():
+		}
+
+		handlesErr := cli.closeHandles()
+
+		cli.closeErr = cli.Err()
+		if cli.closeErr == nil {
+			cli.closeErr = handlesErr
+		}
+
+		cli.fail(ErrClosed)
+		cli.wg.Wait()
+	})
+
+	return cli.closeErr
+}
+
+// closeHandles closes all handles still tracked by the client. It does not
+// share the deadline of Shutdown as requests in flight may have used it up
+// already but gives the server closeHandlesTimeout. The first error is
+// returned
+func (cli *Client) closeHandles() error {
+	cli.stateM.Lock()
+	handles := cli.handles
+	cli.handles = make(map[string]struct{})
+	cli.stateM.Unlock()
+
+	if len(handles) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeHandlesTimeout)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for handle := range handles {
+		wg.Add(1)
+		go func(handle string) {
+			defer wg.Done()
+			defer cli.releaseHandle()
+
+			if _, err := cli.roundTrip(ctx, &sshfxp.Close{Handle: handle}); err != nil {
+				cli.log.Errorf("failed to close handle %q: %s", handle, err)
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(handle)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// track records handle as being opened by the client
+func (cli *Client) track(handle string) {
+	cli.stateM.Lock()
+	defer cli.stateM.Unlock()
+
+	cli.handles[handle] = struct{}{}
+}
+
+// untrack removes handle from the set of opened handles and reports whether
+// it has been opened by the client
+func (cli *Client) untrack(handle string) bool {
+	cli.stateM.Lock()
+	defer cli.stateM.Unlock()
+
+	_, ok := cli.handles[handle]
+	delete(cli.handles, handle)
+
+	return ok
+}
+
+// acquireHandle waits until another handle may be opened without exceeding
+// the MaxOpenHandles limit of the server
+func (cli *Client) acquireHandle(ctx context.Context) error {
+	if cli.handleSlots == nil {
+		return nil
+	}
+
+	select {
+	case cli.handleSlots <- struct{}{}:
+		return nil
+	case <-cli.done:
+		return cli.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseHandle allows another handle to be opened once a handle has been
+// closed or opening it failed
+func (cli *Client) releaseHandle() {
+	if cli.handleSlots == nil {
+		return
+	}
+
+	select {
+	case <-cli.handleSlots:
+	default:
+	}
+}
+
+// fail marks the connection as failed, fails all pending requests with err,
+// stops the reader and writer goroutines and closes the underlying transport.
+// Only the first call has an effect
+func (cli *Client) fail(err error) {
+	cli.errM.Lock()
+	if cli.err != nil {
+		cli.errM.Unlock()
+		return
+	}
+
+	cli.err = err
+	close(cli.done)
+	cli.errM.Unlock()
+
+	cli.router.Fail(err)
+
+	cli.reader.Close()
+	cli.writer.Close()
+}
+
 // DoHandshake establishes a new SFTP connection and performs the initial
 // handshake. The protocol version in use can afterwards be retrieved using the
 // Version method
 func (cli *Client) DoHandshake() error {
 	init := &sshfxp.Init{
-		Version: 3,
+		Version:    3,
+		Extensions: cli.extensions,
 	}
 
-	if _, err := cli.send(init); err != nil {
+	if err := cli.send(init); err != nil {
 		return err
 	}
 
-	pkt := <-cli.incoming
+	var timeout <-chan time.Time
+	if cli.handshakeTimeout > 0 {
+		timer := time.NewTimer(cli.handshakeTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	var pkt sshfxp.Packet
+
+	select {
+	case pkt = <-cli.incoming:
+	case <-timeout:
+		return errors.New("timeout waiting for server version")
+	case err := <-cli.errch:
+		if err == nil {
+			err = io.EOF
+		}
+
+		return err
+	}
 
 	msg, err := pkt.Decode()
 	if err != nil {
@@ -168,162 +504,340 @@ func (cli *Client) DoHandshake() error {
 		}
 
 		cli.version = version.Version
+
+		cli.serverExtensions = make(map[string]string, len(version.Extensions))
+		for _, ext := range version.Extensions {
+			cli.log.Debugf("SFTP server supports extension %s (%s)", ext.Name, ext.Data)
+			cli.serverExtensions[ext.Name] = ext.Data
+		}
 	}
 
 	return nil
 }
 
-// Version returns the SFTP version used. The result is only valid after
-// DoHandshake as been called
-func (cli *Client) Version() uint32 {
-	return cli.version
+// Limits returns the limits announced by the server or DefaultLimits if the
+// server does not support the limits@openssh.com extension
+func (cli *Client) Limits() Limits {
+	return cli.limits
 }
 
-// OpenDir opens a handle to the directory identified by path
-func (cli *Client) OpenDir(path string) (string, error) {
-	open := &sshfxp.OpenDir{
-		Path: path,
+// tune queries the server limits and sizes reads, writes and the number of
+// concurrent requests accordingly. Sizes configured by MaxPacket are only
+// reduced to the limits announced by the server. Unless configured by
+// MaxConcurrentRequests, the number of requests kept in flight is chosen to
+// transfer as many bytes at once as DefaultConcurrency requests of
+// DefaultChunkSize bytes. If the server limits the number of open handles,
+// opening files and directories waits while that many are open
+func (cli *Client) tune() {
+	announced := true
+
+	limits, err := cli.queryLimits()
+	if err != nil {
+		if !errors.Is(err, ErrUnsupported) {
+			cli.log.Warnf("failed to query server limits: %s", err)
+		}
+
+		announced = false
+		limits = DefaultLimits
 	}
 
-	var err error
-	var res_chan <-chan sshfxp.Message
+	cli.limits = limits
 
-	if res_chan, err = cli.send(open); err != nil {
-		return "", err
+	if announced && limits.MaxOpenHandles > 0 {
+		slots := limits.MaxOpenHandles
+		if slots > math.MaxInt32 {
+			slots = math.MaxInt32
+		}
+
+		cli.handleSlots = make(chan struct{}, slots)
+	}
+
+	readSize, writeSize := cli.chunkSize, cli.chunkSize
+	if cli.chunkSize == 0 {
+		readSize, writeSize = MaxPacketLimit, MaxPacketLimit
 	}
 
-	// wait for result
-	var res interface{} = <-res_chan
+	if announced || cli.chunkSize == 0 {
+		readSize = capSize(readSize, limits.MaxReadLength)
+		writeSize = capSize(writeSize, limits.MaxWriteLength)
 
-	if err := sshfxp.IsError(res); err != nil {
-		return "", err
+		if limits.MaxPacketLength > packetOverhead {
+			writeSize = capSize(writeSize, limits.MaxPacketLength-packetOverhead)
+		}
 	}
 
-	switch msg := res.(type) {
-	case *sshfxp.Handle:
-		return msg.Handle, nil
+	cli.readSize, cli.writeSize = readSize, writeSize
+
+	if cli.concurrency == 0 {
+		size := readSize
+		if writeSize > size {
+			size = writeSize
+		}
+
+		cli.concurrency = DefaultConcurrency * DefaultChunkSize / size
+		if cli.concurrency < 1 {
+			cli.concurrency = 1
+		}
 	}
 
-	return "", fmt.Errorf("open_dir: unexpected response: %#v", res)
+	cli.log.Debugf("SFTP transfers use %d byte reads, %d byte writes and %d concurrent requests", cli.readSize, cli.writeSize, cli.concurrency)
 }
 
-// ReadDir reads directory contents for the given handle and returns a list
-// of os.FileInfo
-func (cli *Client) ReadDir(handle string) ([]os.FileInfo, error) {
-	read := &sshfxp.ReadDir{
-		Handle: handle,
+// queryLimits requests the server limits using limits@openssh.com
+func (cli *Client) queryLimits() (Limits, error) {
+	ctx := context.Background()
+	if cli.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cli.handshakeTimeout)
+		defer cancel()
 	}
 
-	resCh, err := cli.send(read)
+	res, err := cli.extendedReply(ctx, sshfxp.ExtLimits, nil)
 	if err != nil {
-		return nil, err
+		return Limits{}, err
+	}
+
+	limits, ok := res.(*sshfxp.Limits)
+	if !ok {
+		return Limits{}, errors.New("unexpected response")
+	}
+
+	return Limits(*limits), nil
+}
+
+// Version returns the SFTP version used. The result is only valid after
+// DoHandshake as been called
+func (cli *Client) Version() uint32 {
+	return cli.version
+}
+
+// Extensions returns the extensions advertised by the server during the
+// handshake, mapping extension names to their data, which usually holds the
+// version of the extension
+func (cli *Client) Extensions() map[string]string {
+	extensions := make(map[string]string, len(cli.serverExtensions))
+	for name, data := range cli.serverExtensions {
+		extensions[name] = data
 	}
 
-	res := <-resCh
+	return extensions
+}
+
+// HasExtension reports whether the server advertised the extension name and
+// returns its data
+func (cli *Client) HasExtension(name string) (string, bool) {
+	data, ok := cli.serverExtensions[name]
+	return data, ok
+}
+
+// Extended sends the SSH_FXP_EXTENDED request name carrying payload, which
+// may be nil. If the server answers with SSH_FXP_EXTENDED_REPLY, the reply is
+// decoded using the payload type registered via sshfxp.RegisterExtension or
+// returned as *sshfxp.ExtendedReply if no reply type is registered. A
+// successful SSH_FXP_STATUS response results in a nil message
+func (cli *Client) Extended(name string, payload sshfxp.Writer) (sshfxp.Message, error) {
+	return cli.ExtendedContext(context.Background(), name, payload)
+}
+
+// ExtendedContext is like Extended but aborts waiting for the server once ctx
+// is done
+func (cli *Client) ExtendedContext(ctx context.Context, name string, payload sshfxp.Writer) (sshfxp.Message, error) {
+	req := &sshfxp.Extended{Request: name}
+	if err := req.SetPayload(payload); err != nil {
+		return nil, err
+	}
 
-	if err := sshfxp.IsError(res); err != nil {
+	res, err := cli.request(ctx, req)
+	if err != nil {
 		return nil, err
 	}
 
 	switch msg := res.(type) {
-	case *sshfxp.Name:
-		var res []os.FileInfo
-		for _, name := range msg.Names {
-			res = append(res, FileInfo{
-				name:    name.Filename,
-				size:    int64(name.Attr.Size),
-				mode:    os.FileMode(name.Attr.Permissions),
-				modtime: time.Unix(int64(name.Attr.MTime), 0),
-				packet:  name,
-			})
+	case *sshfxp.Status:
+		return nil, nil
+	case *sshfxp.ExtendedReply:
+		if !sshfxp.HasExtendedReply(name) {
+			return msg, nil
 		}
 
-		return res, nil
+		return msg.Payload(name)
 	}
 
 	return nil, errors.New("unexpected response")
 }
 
-// Close closes the given file or directory handle
-func (cli *Client) Close(handle string) error {
-	close := &sshfxp.Close{
-		Handle: handle,
-	}
+// OpenDir opens a handle to the directory identified by path
+func (cli *Client) OpenDir(path string) (string, error) {
+	return cli.OpenDirContext(context.Background(), path)
+}
+
+// OpenDirContext is like OpenDir but aborts waiting for the server once ctx
+// is done
+func (cli *Client) OpenDirContext(ctx context.Context, path string) (string, error) {
+	return cli.handle(ctx, &sshfxp.OpenDir{Path: path})
+}
+
+// ReadDir reads the next batch of directory contents for the given handle and
+// returns a list of os.FileInfo. Once all entries have been read, a status
+// error with code sshfxp.StatusEOF is returned
+func (cli *Client) ReadDir(handle string) ([]os.FileInfo, error) {
+	return cli.ReadDirContext(context.Background(), handle)
+}
 
-	resCh, err := cli.send(close)
+// ReadDirContext is like ReadDir but aborts waiting for the server once ctx
+// is done
+func (cli *Client) ReadDirContext(ctx context.Context, handle string) ([]os.FileInfo, error) {
+	names, err := cli.names(ctx, &sshfxp.ReadDir{Handle: handle})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := sshfxp.IsError(<-resCh); err != nil {
-		return err
+	var res []os.FileInfo
+	for _, name := range names {
+		fi := newFileInfo(name.Filename, name.Attr)
+		fi.packet = name
+
+		res = append(res, fi)
 	}
 
-	return nil
+	return res, nil
+}
+
+// CloseHandle closes the given file or directory handle
+func (cli *Client) CloseHandle(handle string) error {
+	return cli.CloseHandleContext(context.Background(), handle)
+}
+
+// CloseHandleContext is like CloseHandle but aborts waiting for the server
+// once ctx is done
+func (cli *Client) CloseHandleContext(ctx context.Context, handle string) error {
+	tracked := cli.untrack(handle)
+
+	err := cli.status(ctx, &sshfxp.Close{Handle: handle})
+
+	if tracked {
+		cli.releaseHandle()
+	}
+
+	return err
 }
 
 // List returns a list of files and directories in a given path. List wraps
-// calles to OpenDir, ReadDir and Close
+// calles to OpenDir, ReadDir and CloseHandle and reads until the server
+// reports the end of the directory
 func (cli *Client) List(path string) ([]os.FileInfo, error) {
-	handle, err := cli.OpenDir(path)
+	return cli.ListContext(context.Background(), path)
+}
+
+// ListContext is like List but aborts once ctx is done
+func (cli *Client) ListContext(ctx context.Context, path string) ([]os.FileInfo, error) {
+	handle, err := cli.OpenDirContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	defer cli.Close(handle)
+	defer cli.CloseHandle(handle)
+
+	var res []os.FileInfo
+
+	dr := cli.DirReaderContext(ctx, handle)
+	for dr.Next() {
+		res = append(res, dr.FileInfo())
+	}
+
+	if err := dr.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// DirReader returns a DirReader iterating over the directory identified by
+// handle. The handle must have been acquired previously by calling OpenDir()
+func (cli *Client) DirReader(handle string) *DirReader {
+	return NewDirReader(handle, cli)
+}
+
+// DirReaderContext is like DirReader but the returned DirReader stops with
+// ctx.Err() once ctx is done
+func (cli *Client) DirReaderContext(ctx context.Context, handle string) *DirReader {
+	dr := NewDirReader(handle, cli)
+	dr.readDir = func(handle string) ([]os.FileInfo, error) {
+		return cli.ReadDirContext(ctx, handle)
+	}
 
-	return cli.ReadDir(handle)
+	return dr
 }
 
 // Open opens the file identifided by path using the access mode specified in
 // flags. If the file is going to be created, attr can hold additional file
-// attributes.
-//
-// BUG: flags and attr is currently not supported
+// attributes. Only the permission bits of attr are used and attr may be nil.
 func (cli *Client) Open(path string, flags uint32, attr os.FileInfo) (string, error) {
-	open := &sshfxp.Open{
+	return cli.OpenContext(context.Background(), path, flags, attr)
+}
+
+// OpenContext is like Open but aborts waiting for the server once ctx is done
+func (cli *Client) OpenContext(ctx context.Context, path string, flags uint32, attr os.FileInfo) (string, error) {
+	return cli.handle(ctx, &sshfxp.Open{
 		Filename:   path,
 		PFlags:     flags,
-		Attributes: sshfxp.Attr{}, // TODO: not yet supported
+		Attributes: fileInfoAttr(attr),
+	})
+}
+
+// OpenFile opens the file identified by path and returns a *File similar to
+// os.OpenFile. flag is a combination of os.O_* flags and perm is used as the
+// permission bits if the file is created
+func (cli *Client) OpenFile(path string, flag int, perm os.FileMode) (*File, error) {
+	return cli.OpenFileContext(context.Background(), path, flag, perm)
+}
+
+// OpenFileContext is like OpenFile but aborts waiting for the server once ctx
+// is done
+func (cli *Client) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (*File, error) {
+	open := &sshfxp.Open{
+		Filename: path,
+		PFlags:   openFlags(flag),
 	}
 
-	resCh, err := cli.send(open)
-	if err != nil {
-		return "", err
+	if flag&os.O_CREATE != 0 {
+		open.Attributes = permAttr(perm)
 	}
 
-	res := <-resCh
-	if err := sshfxp.IsError(res); err != nil {
-		return "", err
+	handle, err := cli.handle(ctx, open)
+	if err != nil {
+		return nil, err
 	}
 
-	switch msg := res.(type) {
-	case *sshfxp.Handle:
-		return msg.Handle, nil
+	concurrency := cli.concurrency
+	if flag&os.O_APPEND != 0 {
+		// the server ignores offsets in append mode so writes must not be
+		// reordered
+		concurrency = 1
 	}
 
-	return "", errors.New("unexpected response")
+	return newFile(path, handle, cli, cli.readSize, cli.writeSize, concurrency), nil
 }
 
 // Read reads `length` bytes of data from the file identified by handle and
 // starting at offset. The file handle must have been acquired previously by
 // calling Open()
 func (cli *Client) Read(handle string, offset uint64, length uint32) ([]byte, error) {
+	return cli.ReadContext(context.Background(), handle, offset, length)
+}
+
+// ReadContext is like Read but aborts waiting for the server once ctx is done
+func (cli *Client) ReadContext(ctx context.Context, handle string, offset uint64, length uint32) ([]byte, error) {
 	read := &sshfxp.Read{
 		Handle: handle,
 		Offset: offset,
 		Length: length,
 	}
 
-	resCh, err := cli.send(read)
+	res, err := cli.request(ctx, read)
 	if err != nil {
 		return nil, err
 	}
 
-	res := <-resCh
-	if err := sshfxp.IsError(res); err != nil {
-		return nil, err
-	}
-
 	switch msg := res.(type) {
 	case *sshfxp.Data:
 		return []byte(msg.Data), nil
@@ -336,92 +850,641 @@ func (cli *Client) Read(handle string, offset uint64, length uint32) ([]byte, er
 // at offset. The file handle must have been acquired previously by calling
 // Open()
 func (cli *Client) Write(handle string, offset uint64, data []byte) error {
-	write := &sshfxp.Write{
+	return cli.WriteContext(context.Background(), handle, offset, data)
+}
+
+// WriteContext is like Write but aborts waiting for the server once ctx is
+// done
+func (cli *Client) WriteContext(ctx context.Context, handle string, offset uint64, data []byte) error {
+	return cli.status(ctx, &sshfxp.Write{
 		Handle: handle,
 		Offset: offset,
 		Data:   string(data),
-	}
-
-	resCh, err := cli.send(write)
-	if err != nil {
-		return err
-	}
-
-	if err := sshfxp.IsError(<-resCh); err != nil {
-		return err
-	}
-
-	return nil
+	})
 }
 
 // Remove removes the file identified by path.
 func (cli *Client) Remove(path string) error {
-	if resCh, err := cli.send(&sshfxp.Remove{File: path}); err != nil {
-		return err
-	} else if err := sshfxp.IsError(<-resCh); err != nil {
-		return err
-	}
+	return cli.RemoveContext(context.Background(), path)
+}
 
-	return nil
+// RemoveContext is like Remove but aborts waiting for the server once ctx is
+// done
+func (cli *Client) RemoveContext(ctx context.Context, path string) error {
+	return cli.status(ctx, &sshfxp.Remove{File: path})
 }
 
-// Rename renames the file or directory identified by oldPath to newPath
+// Rename renames the file or directory identified by oldPath to newPath.
+// Servers following the specification fail if newPath exists unless the
+// client has been created with ReplaceOnRename
 func (cli *Client) Rename(oldPath, newPath string) error {
-	if resCh, err := cli.send(&sshfxp.Rename{OldPath: oldPath, NewPath: newPath}); err != nil {
-		return err
-	} else if err := sshfxp.IsError(<-resCh); err != nil {
-		return err
+	return cli.RenameContext(context.Background(), oldPath, newPath)
+}
+
+// RenameContext is like Rename but aborts waiting for the server once ctx is
+// done
+func (cli *Client) RenameContext(ctx context.Context, oldPath, newPath string) error {
+	if cli.renameReplace {
+		return cli.replace(ctx, oldPath, newPath)
 	}
 
-	return nil
+	return cli.status(ctx, &sshfxp.Rename{OldPath: oldPath, NewPath: newPath})
 }
 
-// MkDir creates the directory path using os.FileInfo attributes
-func (cli *Client) MkDir(path string, attr os.FileInfo) error {
-	mkdir := &sshfxp.MkDir{
-		Path: path,
-		Attr: sshfxp.Attr{},
+// PosixRename renames oldPath to newPath, atomically replacing newPath if it
+// exists, using the posix-rename@openssh.com extension. If the server does
+// not support the extension an *ExtensionUnsupportedError is returned
+func (cli *Client) PosixRename(oldPath, newPath string) error {
+	return cli.PosixRenameContext(context.Background(), oldPath, newPath)
+}
+
+// PosixRenameContext is like PosixRename but aborts waiting for the server
+// once ctx is done
+func (cli *Client) PosixRenameContext(ctx context.Context, oldPath, newPath string) error {
+	return cli.extended(ctx, sshfxp.ExtPosixRename, &sshfxp.PosixRename{
+		OldPath: oldPath,
+		NewPath: newPath,
+	})
+}
+
+// StatVFS returns statistics of the file system containing path using the
+// statvfs@openssh.com extension. If the server does not support the
+// extension an *ExtensionUnsupportedError is returned
+func (cli *Client) StatVFS(path string) (*StatVFS, error) {
+	return cli.StatVFSContext(context.Background(), path)
+}
+
+// StatVFSContext is like StatVFS but aborts waiting for the server once ctx
+// is done
+func (cli *Client) StatVFSContext(ctx context.Context, path string) (*StatVFS, error) {
+	return cli.statVFS(ctx, sshfxp.ExtStatVFS, &sshfxp.StatVFSPath{Path: path})
+}
+
+// FStatVFS is like StatVFS but returns statistics of the file system
+// containing the file opened as handle using fstatvfs@openssh.com
+func (cli *Client) FStatVFS(handle string) (*StatVFS, error) {
+	return cli.FStatVFSContext(context.Background(), handle)
+}
+
+// FStatVFSContext is like FStatVFS but aborts waiting for the server once
+// ctx is done
+func (cli *Client) FStatVFSContext(ctx context.Context, handle string) (*StatVFS, error) {
+	return cli.statVFS(ctx, sshfxp.ExtFStatVFS, &sshfxp.StatVFSHandle{Handle: handle})
+}
+
+func (cli *Client) statVFS(ctx context.Context, name string, payload sshfxp.Writer) (*StatVFS, error) {
+	res, err := cli.extendedReply(ctx, name, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	st, ok := res.(*sshfxp.StatVFS)
+	if !ok {
+		return nil, errors.New("unexpected response")
+	}
+
+	return (*StatVFS)(st), nil
+}
+
+// Link creates newname as a hard link to oldname using the
+// hardlink@openssh.com extension. If the server does not support the
+// extension an *ExtensionUnsupportedError is returned
+func (cli *Client) Link(oldname, newname string) error {
+	return cli.LinkContext(context.Background(), oldname, newname)
+}
+
+// LinkContext is like Link but aborts waiting for the server once ctx is
+// done
+func (cli *Client) LinkContext(ctx context.Context, oldname, newname string) error {
+	return cli.extended(ctx, sshfxp.ExtHardlink, &sshfxp.Hardlink{
+		OldPath: oldname,
+		NewPath: newname,
+	})
+}
+
+// Fsync asks the server to commit the contents of the file opened as handle
+// to stable storage using the fsync@openssh.com extension. If the server
+// does not support the extension an *ExtensionUnsupportedError is returned
+func (cli *Client) Fsync(handle string) error {
+	return cli.FsyncContext(context.Background(), handle)
+}
+
+// FsyncContext is like Fsync but aborts waiting for the server once ctx is
+// done
+func (cli *Client) FsyncContext(ctx context.Context, handle string) error {
+	return cli.extended(ctx, sshfxp.ExtFSync, &sshfxp.FSync{Handle: handle})
+}
+
+// replace renames oldPath to newPath replacing an existing newPath. Without
+// posix-rename@openssh.com, newPath is moved aside first and restored if the
+// rename fails. This fallback is not atomic: newPath does not exist between
+// the two renames, and other clients creating newPath or modifying the moved
+// file in the meantime can make the rename or the restore fail. Only files,
+// including symbolic links, are replaced this way. If either path is a
+// directory or can not be inspected, the error of the first rename is
+// returned unchanged
+func (cli *Client) replace(ctx context.Context, oldPath, newPath string) error {
+	if _, ok := cli.HasExtension(sshfxp.ExtPosixRename); ok {
+		return cli.PosixRenameContext(ctx, oldPath, newPath)
+	}
+
+	err := cli.status(ctx, &sshfxp.Rename{OldPath: oldPath, NewPath: newPath})
+	if err == nil {
+		return nil
+	}
+
+	// like rename(2), directories are neither replaced nor moved onto
+	// files. A missing newPath means the rename failed for another reason
+	dst, serr := cli.LstatContext(ctx, newPath)
+	if serr != nil || dst.IsDir() {
+		return err
+	}
+
+	src, serr := cli.LstatContext(ctx, oldPath)
+	if serr != nil || src.IsDir() {
+		return err
 	}
 
-	if resCh, err := cli.send(mkdir); err != nil {
+	backup := path.Join(path.Dir(newPath), fmt.Sprintf(".%s.%d.replaced", path.Base(newPath), time.Now().UnixNano()))
+
+	if err := cli.status(ctx, &sshfxp.Rename{OldPath: newPath, NewPath: backup}); err != nil {
 		return err
-	} else if err := sshfxp.IsError(<-resCh); err != nil {
+	}
+
+	if err := cli.status(ctx, &sshfxp.Rename{OldPath: oldPath, NewPath: newPath}); err != nil {
+		// restore newPath even if ctx is already done
+		if rerr := cli.status(context.Background(), &sshfxp.Rename{OldPath: backup, NewPath: newPath}); rerr != nil {
+			cli.log.Errorf("failed to restore %s from %s: %s", newPath, backup, rerr)
+		}
+
 		return err
 	}
 
+	if err := cli.status(ctx, &sshfxp.Remove{File: backup}); err != nil {
+		// the replaced path may have been an empty directory
+		if err := cli.status(ctx, &sshfxp.RmDir{Path: backup}); err != nil {
+			cli.log.Warnf("failed to remove replaced file %s: %s", backup, err)
+		}
+	}
+
 	return nil
 }
 
+// MkDir creates the directory path using os.FileInfo attributes. Only the
+// permission bits of attr are used and attr may be nil.
+func (cli *Client) MkDir(path string, attr os.FileInfo) error {
+	return cli.MkDirContext(context.Background(), path, attr)
+}
+
+// MkDirContext is like MkDir but aborts waiting for the server once ctx is
+// done
+func (cli *Client) MkDirContext(ctx context.Context, path string, attr os.FileInfo) error {
+	return cli.status(ctx, &sshfxp.MkDir{
+		Path: path,
+		Attr: fileInfoAttr(attr),
+	})
+}
+
 // RmDir removes the directory path
 func (cli *Client) RmDir(path string) error {
-	if resCh, err := cli.send(&sshfxp.RmDir{Path: path}); err != nil {
+	return cli.RmDirContext(context.Background(), path)
+}
+
+// RmDirContext is like RmDir but aborts waiting for the server once ctx is
+// done
+func (cli *Client) RmDirContext(ctx context.Context, path string) error {
+	return cli.status(ctx, &sshfxp.RmDir{Path: path})
+}
+
+// Stat returns file information for the file or directory identified by path.
+// Symbolic links are followed by the server
+func (cli *Client) Stat(p string) (os.FileInfo, error) {
+	return cli.StatContext(context.Background(), p)
+}
+
+// StatContext is like Stat but aborts waiting for the server once ctx is done
+func (cli *Client) StatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	return cli.stat(ctx, path.Base(p), &sshfxp.Stat{Path: p})
+}
+
+// Lstat returns file information for the file or directory identified by path.
+// If path is a symbolic link, information about the link itself is returned
+func (cli *Client) Lstat(p string) (os.FileInfo, error) {
+	return cli.LstatContext(context.Background(), p)
+}
+
+// LstatContext is like Lstat but aborts waiting for the server once ctx is
+// done
+func (cli *Client) LstatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	return cli.stat(ctx, path.Base(p), &sshfxp.LStat{Path: p})
+}
+
+// Fstat returns file information for the file or directory identified by
+// handle. The handle must have been acquired previously by calling Open() or
+// OpenDir()
+func (cli *Client) Fstat(handle string) (os.FileInfo, error) {
+	return cli.FstatContext(context.Background(), handle)
+}
+
+// FstatContext is like Fstat but aborts waiting for the server once ctx is
+// done
+func (cli *Client) FstatContext(ctx context.Context, handle string) (os.FileInfo, error) {
+	return cli.stat(ctx, "", &sshfxp.FStat{Handle: handle})
+}
+
+// RealPath canonicalizes path on the server into an absolute path. Calling
+// RealPath with "." returns the current working directory of the server,
+// usually the users home directory
+func (cli *Client) RealPath(path string) (string, error) {
+	return cli.RealPathContext(context.Background(), path)
+}
+
+// RealPathContext is like RealPath but aborts waiting for the server once ctx
+// is done
+func (cli *Client) RealPathContext(ctx context.Context, path string) (string, error) {
+	return cli.name(ctx, &sshfxp.RealPath{Path: path})
+}
+
+// ReadLink returns the target of the symbolic link identified by path
+func (cli *Client) ReadLink(path string) (string, error) {
+	return cli.ReadLinkContext(context.Background(), path)
+}
+
+// ReadLinkContext is like ReadLink but aborts waiting for the server once ctx
+// is done
+func (cli *Client) ReadLinkContext(ctx context.Context, path string) (string, error) {
+	return cli.name(ctx, &sshfxp.ReadLink{Path: path})
+}
+
+// Symlink creates newname as a symbolic link pointing to oldname, matching the
+// argument order of os.Symlink. The order of arguments on the wire is
+// configured by the WithSymlinkOrder option
+func (cli *Client) Symlink(oldname, newname string) error {
+	return cli.SymlinkContext(context.Background(), oldname, newname)
+}
+
+// SymlinkContext is like Symlink but aborts waiting for the server once ctx
+// is done
+func (cli *Client) SymlinkContext(ctx context.Context, oldname, newname string) error {
+	symlink := &sshfxp.Symlink{
+		LinkPath:   newname,
+		TargetPath: oldname,
+	}
+
+	if cli.symlinkOrder == SymlinkOpenSSH {
+		symlink.LinkPath, symlink.TargetPath = oldname, newname
+	}
+
+	return cli.status(ctx, symlink)
+}
+
+// SetAttributes changes the attributes of the file or directory identified by
+// path. Only attributes with their flag set in attr.Flags are changed
+func (cli *Client) SetAttributes(path string, attr sshfxp.Attr) error {
+	return cli.SetAttributesContext(context.Background(), path, attr)
+}
+
+// SetAttributesContext is like SetAttributes but aborts waiting for the server
+// once ctx is done
+func (cli *Client) SetAttributesContext(ctx context.Context, path string, attr sshfxp.Attr) error {
+	return cli.status(ctx, &sshfxp.SetStat{Path: path, Attr: attr})
+}
+
+// FSetAttributes changes the attributes of the file or directory identified by
+// handle. Only attributes with their flag set in attr.Flags are changed
+func (cli *Client) FSetAttributes(handle string, attr sshfxp.Attr) error {
+	return cli.FSetAttributesContext(context.Background(), handle, attr)
+}
+
+// FSetAttributesContext is like FSetAttributes but aborts waiting for the
+// server once ctx is done
+func (cli *Client) FSetAttributesContext(ctx context.Context, handle string, attr sshfxp.Attr) error {
+	return cli.status(ctx, &sshfxp.FSetStat{Handle: handle, Attr: attr})
+}
+
+// Chmod changes the permission bits of the file or directory identified by
+// path
+func (cli *Client) Chmod(path string, mode os.FileMode) error {
+	return cli.ChmodContext(context.Background(), path, mode)
+}
+
+// ChmodContext is like Chmod but aborts waiting for the server once ctx is
+// done
+func (cli *Client) ChmodContext(ctx context.Context, path string, mode os.FileMode) error {
+	return cli.SetAttributesContext(ctx, path, permAttr(mode))
+}
+
+// Fchmod changes the permission bits of the file or directory identified by
+// handle
+func (cli *Client) Fchmod(handle string, mode os.FileMode) error {
+	return cli.FchmodContext(context.Background(), handle, mode)
+}
+
+// FchmodContext is like Fchmod but aborts waiting for the server once ctx is
+// done
+func (cli *Client) FchmodContext(ctx context.Context, handle string, mode os.FileMode) error {
+	return cli.FSetAttributesContext(ctx, handle, permAttr(mode))
+}
+
+// Chown changes the numeric user and group ID of the file or directory
+// identified by path
+func (cli *Client) Chown(path string, uid, gid int) error {
+	return cli.ChownContext(context.Background(), path, uid, gid)
+}
+
+// ChownContext is like Chown but aborts waiting for the server once ctx is
+// done
+func (cli *Client) ChownContext(ctx context.Context, path string, uid, gid int) error {
+	return cli.SetAttributesContext(ctx, path, ownerAttr(uid, gid))
+}
+
+// Fchown changes the numeric user and group ID of the file or directory
+// identified by handle
+func (cli *Client) Fchown(handle string, uid, gid int) error {
+	return cli.FchownContext(context.Background(), handle, uid, gid)
+}
+
+// FchownContext is like Fchown but aborts waiting for the server once ctx is
+// done
+func (cli *Client) FchownContext(ctx context.Context, handle string, uid, gid int) error {
+	return cli.FSetAttributesContext(ctx, handle, ownerAttr(uid, gid))
+}
+
+// Chtimes changes the access and modification time of the file or directory
+// identified by path
+func (cli *Client) Chtimes(path string, atime, mtime time.Time) error {
+	return cli.ChtimesContext(context.Background(), path, atime, mtime)
+}
+
+// ChtimesContext is like Chtimes but aborts waiting for the server once ctx
+// is done
+func (cli *Client) ChtimesContext(ctx context.Context, path string, atime, mtime time.Time) error {
+	return cli.SetAttributesContext(ctx, path, timesAttr(atime, mtime))
+}
+
+// Fchtimes changes the access and modification time of the file or directory
+// identified by handle
+func (cli *Client) Fchtimes(handle string, atime, mtime time.Time) error {
+	return cli.FchtimesContext(context.Background(), handle, atime, mtime)
+}
+
+// FchtimesContext is like Fchtimes but aborts waiting for the server once ctx
+// is done
+func (cli *Client) FchtimesContext(ctx context.Context, handle string, atime, mtime time.Time) error {
+	return cli.FSetAttributesContext(ctx, handle, timesAttr(atime, mtime))
+}
+
+// Truncate changes the size of the file identified by path
+func (cli *Client) Truncate(path string, size int64) error {
+	return cli.TruncateContext(context.Background(), path, size)
+}
+
+// TruncateContext is like Truncate but aborts waiting for the server once ctx
+// is done
+func (cli *Client) TruncateContext(ctx context.Context, path string, size int64) error {
+	return cli.SetAttributesContext(ctx, path, sizeAttr(size))
+}
+
+// Ftruncate changes the size of the file identified by handle
+func (cli *Client) Ftruncate(handle string, size int64) error {
+	return cli.FtruncateContext(context.Background(), handle, size)
+}
+
+// FtruncateContext is like Ftruncate but aborts waiting for the server once
+// ctx is done
+func (cli *Client) FtruncateContext(ctx context.Context, handle string, size int64) error {
+	return cli.FSetAttributesContext(ctx, handle, sizeAttr(size))
+}
+
+// extended sends the SSH_FXP_EXTENDED request name carrying payload and
+// waits for a successful SSH_FXP_STATUS response. If the server did not
+// advertise the extension an *ExtensionUnsupportedError is returned
+func (cli *Client) extended(ctx context.Context, name string, payload sshfxp.Writer) error {
+	if _, ok := cli.HasExtension(name); !ok {
+		return &ExtensionUnsupportedError{Name: name}
+	}
+
+	req := &sshfxp.Extended{Request: name}
+	if err := req.SetPayload(payload); err != nil {
 		return err
-	} else if err := sshfxp.IsError(<-resCh); err != nil {
+	}
+
+	return cli.status(ctx, req)
+}
+
+// extendedReply sends the SSH_FXP_EXTENDED request name carrying payload and
+// returns the decoded SSH_FXP_EXTENDED_REPLY. If the server did not advertise
+// the extension an *ExtensionUnsupportedError is returned
+func (cli *Client) extendedReply(ctx context.Context, name string, payload sshfxp.Writer) (sshfxp.Message, error) {
+	if _, ok := cli.HasExtension(name); !ok {
+		return nil, &ExtensionUnsupportedError{Name: name}
+	}
+
+	res, err := cli.ExtendedContext(ctx, name, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if res == nil {
+		return nil, errors.New("unexpected response")
+	}
+
+	return res, nil
+}
+
+// request sends x to the server and waits for the response. Status responses
+// carrying an error are returned as *sshfxp.FxpStatusError. If ctx is done
+// before the response arrives, the request is abandoned and ctx.Err() is
+// returned. A late response is discarded, except for handles opened by an
+// abandoned SSH_FXP_OPEN or SSH_FXP_OPENDIR which are closed. Once the client
+// is closing, request returns ErrClosed
+func (cli *Client) request(ctx context.Context, x sshfxp.Message) (sshfxp.Message, error) {
+	cli.stateM.Lock()
+	if cli.closing {
+		cli.stateM.Unlock()
+		return nil, ErrClosed
+	}
+	cli.inflight.Add(1)
+	cli.stateM.Unlock()
+
+	defer cli.inflight.Done()
+
+	return cli.roundTrip(ctx, x)
+}
+
+// roundTrip is like request but does not check whether the client is closing
+func (cli *Client) roundTrip(ctx context.Context, x sshfxp.Message) (sshfxp.Message, error) {
+	header, ok := x.(sshfxp.Header)
+	if !ok {
+		return nil, fmt.Errorf("%T does not carry a request ID", x)
+	}
+
+	id, resCh, err := cli.router.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	header.SetID(id)
+
+	var pkt sshfxp.Packet
+	if err := pkt.Encode(x); err != nil {
+		cli.router.Cancel(id)
+		return nil, err
+	}
+
+	select {
+	case cli.outgoing <- pkt:
+	case <-cli.done:
+		return nil, cli.Err()
+	case <-ctx.Done():
+		cli.router.Cancel(id)
+		return nil, ctx.Err()
+	}
+
+	select {
+	case res, ok := <-resCh:
+		if !ok {
+			// the connection failed while waiting for the response
+			return nil, cli.Err()
+		}
+
+		if err := sshfxp.IsError(res); err != nil {
+			return nil, err
+		}
+
+		return res, nil
+	case <-ctx.Done():
+		switch x.(type) {
+		case *sshfxp.Open, *sshfxp.OpenDir:
+			// the server may still open the file, keep waiting so the
+			// handle does not leak
+			go cli.closeLateHandle(resCh)
+		default:
+			cli.router.Cancel(id)
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+// closeLateHandle waits for the response of an abandoned request and closes
+// the handle it carries, if any
+func (cli *Client) closeLateHandle(resCh <-chan sshfxp.Message) {
+	res, ok := <-resCh
+	if !ok {
+		return
+	}
+
+	h, ok := res.(*sshfxp.Handle)
+	if !ok {
+		return
+	}
+
+	if _, err := cli.roundTrip(context.Background(), &sshfxp.Close{Handle: h.Handle}); err != nil {
+		cli.log.Debugf("failed to close abandoned handle %q: %s", h.Handle, err)
+	}
+}
+
+// status sends x and waits for a successful SSH_FXP_STATUS response
+func (cli *Client) status(ctx context.Context, x sshfxp.Message) error {
+	res, err := cli.request(ctx, x)
+	if err != nil {
 		return err
 	}
 
+	if _, ok := res.(*sshfxp.Status); !ok {
+		return errors.New("unexpected response")
+	}
+
 	return nil
 }
 
-func (cli *Client) send(x sshfxp.Message) (<-chan sshfxp.Message, error) {
-	var pkt sshfxp.Packet
-	var res <-chan sshfxp.Message
+// handle sends x and returns the handle of the SSH_FXP_HANDLE response. If
+// the server limits the number of open handles, handle waits until fewer
+// handles are open
+func (cli *Client) handle(ctx context.Context, x sshfxp.Message) (string, error) {
+	if err := cli.acquireHandle(ctx); err != nil {
+		return "", err
+	}
+
+	res, err := cli.request(ctx, x)
+	if err != nil {
+		cli.releaseHandle()
+		return "", err
+	}
 
-	if header, ok := (interface{}(x)).(sshfxp.Header); ok {
-		id, ch := cli.router.Get()
+	switch msg := res.(type) {
+	case *sshfxp.Handle:
+		cli.track(msg.Handle)
+		return msg.Handle, nil
+	}
 
-		header.SetID(id)
+	cli.releaseHandle()
+	return "", fmt.Errorf("unexpected response: %#v", res)
+}
 
-		res = ch
+// stat sends x and returns the attributes of the SSH_FXP_ATTRS response as
+// os.FileInfo using name as the file name
+func (cli *Client) stat(ctx context.Context, name string, x sshfxp.Message) (os.FileInfo, error) {
+	res, err := cli.request(ctx, x)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := pkt.Encode(x); err != nil {
+	switch msg := res.(type) {
+	case *sshfxp.Attrs:
+		return newFileInfo(name, msg.Attr), nil
+	}
+
+	return nil, errors.New("unexpected response")
+}
+
+// names sends x and returns the names of the SSH_FXP_NAME response
+func (cli *Client) names(ctx context.Context, x sshfxp.Message) ([]sshfxp.NameInfo, error) {
+	res, err := cli.request(ctx, x)
+	if err != nil {
 		return nil, err
 	}
 
-	cli.outgoing <- pkt
+	switch msg := res.(type) {
+	case *sshfxp.Name:
+		return msg.Names, nil
+	}
+
+	return nil, errors.New("unexpected response")
+}
+
+// name sends x and returns the filename of the single-entry SSH_FXP_NAME
+// response
+func (cli *Client) name(ctx context.Context, x sshfxp.Message) (string, error) {
+	names, err := cli.names(ctx, x)
+	if err != nil {
+		return "", err
+	}
 
-	return res, nil
+	if len(names) != 1 {
+		return "", fmt.Errorf("expected one name but got %d", len(names))
+	}
+
+	return names[0].Filename, nil
+}
+
+// send encodes x and queues it for transmission. It is used for packets that
+// do not expect a response routed by request ID, like SSH_FXP_INIT
+func (cli *Client) send(x sshfxp.Message) error {
+	var pkt sshfxp.Packet
+
+	if err := pkt.Encode(x); err != nil {
+		return err
+	}
+
+	select {
+	case cli.outgoing <- pkt:
+	case <-cli.done:
+		return cli.Err()
+	}
+
+	return nil
 }
 
 func (cli *Client) handleMessage(msg sshfxp.Packet) error {
@@ -437,34 +1500,43 @@ func (cli *Client) handleMessage(msg sshfxp.Packet) error {
 	return nil
 }
 
-// FileReader returns an io.Reader attached to the remote file identifed by
-// path
-func (cli *Client) FileReader(path string) (io.Reader, error) {
-	return NewFileReader(path, cli)
+// FileReader returns an io.ReadCloser attached to the remote file identifed
+// by path. The remote file stays open until the reader is closed
+func (cli *Client) FileReader(path string) (io.ReadCloser, error) {
+	return NewFileReaderSize(path, cli, cli.readSize, cli.concurrency)
 }
 
 // FileWriter returns an io.WriteCloser attached to the remote file identified
-// by path
+// by path. The file is created or truncated. Write errors are reported by the
+// Close method of the returned writer
 func (cli *Client) FileWriter(path string) (io.WriteCloser, error) {
-	return NewFileWriter(path, cli)
+	fw, err := NewFileWriterSize(path, cli, cli.writeSize, cli.concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	return fw, nil
 }
 
 // Put uploads a local file identified by local to remote
 func (cli *Client) Put(local, remote string) error {
-	rw, err := cli.FileWriter(remote)
+	f, err := os.Open(local)
 	if err != nil {
 		return err
 	}
-	defer rw.Close()
+	defer f.Close()
 
-	f, err := os.Open(local)
+	rw, err := cli.FileWriter(remote)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	_, err = io.Copy(rw, f)
-	return err
+	if _, err := io.Copy(rw, f); err != nil {
+		rw.Close()
+		return err
+	}
+
+	return rw.Close()
 }
 
 // Get downloads the remote file `remote` and stores it underl `local`
@@ -473,6 +1545,7 @@ func (cli *Client) Get(remote, local string) error {
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
 	f, err := os.Create(local)
 	if err != nil {
@@ -483,3 +1556,150 @@ func (cli *Client) Get(remote, local string) error {
 	_, err = io.Copy(f, r)
 	return err
 }
+
+// CopyFile copies the remote file src to the remote file dst. If overwrite is
+// false, CopyFile fails if dst exists. The server copies the file itself if
+// it supports the copy-file or copy-data extension. Otherwise, including
+// when the server rejects the extension with SSH_FX_OP_UNSUPPORTED, the data
+// is transferred through the client
+func (cli *Client) CopyFile(src, dst string, overwrite bool) error {
+	return cli.CopyFileContext(context.Background(), src, dst, overwrite)
+}
+
+// CopyFileContext is like CopyFile but aborts once ctx is done
+func (cli *Client) CopyFileContext(ctx context.Context, src, dst string, overwrite bool) error {
+	err := cli.extended(ctx, sshfxp.ExtCopyFile, &sshfxp.CopyFile{
+		Source:      src,
+		Destination: dst,
+		Overwrite:   overwrite,
+	})
+
+	if !isUnsupported(err) {
+		return err
+	}
+
+	in, err := cli.OpenFileContext(ctx, src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if !overwrite {
+		flag |= os.O_EXCL
+	} else if cli.samePath(ctx, src, dst) {
+		return fmt.Errorf("%s and %s are the same file", src, dst)
+	}
+
+	// SFTP attributes do not identify files, so dst may still be src
+	// reached through a link. dst is therefore overwritten in place and
+	// truncated afterwards instead of being opened with O_TRUNC, which
+	// leaves src intact if both are the same file
+	out, err := cli.OpenFileContext(ctx, dst, flag, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if err := cli.CopyRangeContext(ctx, in.Handle(), 0, 0, out.Handle(), 0); err != nil {
+		out.Close()
+		return err
+	}
+
+	if fi, err = in.Stat(); err == nil {
+		err = cli.FtruncateContext(ctx, out.Handle(), fi.Size())
+	}
+
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// samePath returns true if the server resolves a and b to the same path
+func (cli *Client) samePath(ctx context.Context, a, b string) bool {
+	ra, err := cli.RealPathContext(ctx, a)
+	if err != nil {
+		return false
+	}
+
+	rb, err := cli.RealPathContext(ctx, b)
+	if err != nil {
+		return false
+	}
+
+	return ra == rb
+}
+
+// CopyRange copies length bytes of the file opened as srcHandle starting at
+// srcOffset to the file opened as dstHandle starting at dstOffset. A zero
+// length copies until the end of the source file. The server copies the data
+// itself if it supports the copy-data extension. Otherwise, including when
+// the server rejects the extension with SSH_FX_OP_UNSUPPORTED, the data is
+// transferred through the client keeping multiple read and write requests in
+// flight
+func (cli *Client) CopyRange(srcHandle string, srcOffset, length uint64, dstHandle string, dstOffset uint64) error {
+	return cli.CopyRangeContext(context.Background(), srcHandle, srcOffset, length, dstHandle, dstOffset)
+}
+
+// CopyRangeContext is like CopyRange but aborts once ctx is done
+func (cli *Client) CopyRangeContext(ctx context.Context, srcHandle string, srcOffset, length uint64, dstHandle string, dstOffset uint64) error {
+	err := cli.extended(ctx, sshfxp.ExtCopyData, &sshfxp.CopyData{
+		ReadHandle:  srcHandle,
+		ReadOffset:  srcOffset,
+		Length:      length,
+		WriteHandle: dstHandle,
+		WriteOffset: dstOffset,
+	})
+
+	if !isUnsupported(err) {
+		return err
+	}
+
+	return cli.copyRange(ctx, srcHandle, srcOffset, length, dstHandle, dstOffset)
+}
+
+// copyRange copies data between two remote files through the client. Reads
+// and writes are pipelined using readAhead and writeBehind
+func (cli *Client) copyRange(ctx context.Context, srcHandle string, srcOffset, length uint64, dstHandle string, dstOffset uint64) error {
+	n := int64(-1)
+	if length > 0 {
+		n = int64(length)
+	}
+
+	pr, pw := io.Pipe()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := readAhead(cli, srcHandle, srcOffset, n, cli.readSize, cli.concurrency, pw)
+		pw.CloseWithError(err)
+		readErr <- err
+	}()
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pr.CloseWithError(ctx.Err())
+		case <-stop:
+		}
+	}()
+
+	_, err := writeBehind(cli, dstHandle, dstOffset, cli.writeSize, cli.concurrency, pr)
+	close(stop)
+
+	// unblock the reader if writing failed early
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	if rerr := <-readErr; err == nil {
+		err = rerr
+	}
+
+	return err
+}
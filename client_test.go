@@ -0,0 +1,464 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+	"golang.org/x/net/context"
+)
+
+// blockingHandler blocks Open until release is closed and reports closed
+// file handles on closed
+type blockingHandler struct {
+	*MemoryHandler
+
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (h *blockingHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	<-h.release
+
+	f, err := h.MemoryHandler.Open(p, flag, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &closeNotifyFile{f, h.closed}, nil
+}
+
+type closeNotifyFile struct {
+	FileHandle
+
+	closed chan struct{}
+}
+
+func (f *closeNotifyFile) Close() error {
+	close(f.closed)
+	return f.FileHandle.Close()
+}
+
+// newRawClient connects a Client to serve, which speaks the protocol on the
+// server side of the connection using readPacket and writePacket. The
+// connection is closed once serve returns
+func newRawClient(t *testing.T, serve func(r io.Reader, w io.Writer), opts ...ClientOption) (*Client, error) {
+	t.Helper()
+
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	go func() {
+		serve(serverReader, serverWriter)
+		serverReader.Close()
+		serverWriter.Close()
+	}()
+
+	cli, err := NewClientPipe(clientReader, clientWriter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Cleanup(func() { cli.Close() })
+
+	return cli, nil
+}
+
+// newBareClient connects a Client to a server advertising no extensions and
+// ignoring all requests after the handshake
+func newBareClient(t *testing.T, opts ...ClientOption) *Client {
+	t.Helper()
+
+	cli, err := newRawClient(t, func(r io.Reader, w io.Writer) {
+		if err := serveHandshake(r, w); err != nil {
+			return
+		}
+
+		io.Copy(ioutil.Discard, r)
+	}, opts...)
+	if err != nil {
+		t.Fatalf("NewClientPipe: %s", err)
+	}
+
+	return cli
+}
+
+// readPacket reads and decodes the next message sent by the client
+func readPacket(r io.Reader) (sshfxp.Message, error) {
+	var pkt sshfxp.Packet
+	if err := pkt.Read(r); err != nil {
+		return nil, err
+	}
+
+	return pkt.Decode()
+}
+
+// writePacket sends x to the client
+func writePacket(w io.Writer, x sshfxp.Message) error {
+	var pkt sshfxp.Packet
+	if err := pkt.Encode(x); err != nil {
+		return err
+	}
+
+	data, err := pkt.Bytes()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func TestOpenContextClosesLateHandle(t *testing.T) {
+	h := &blockingHandler{
+		MemoryHandler: NewMemoryHandler(),
+		release:       make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+
+	cli := newServerClient(t, h)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := cli.OpenFileContext(ctx, "/file", os.O_WRONLY|os.O_CREATE, 0644); err != context.DeadlineExceeded {
+		t.Fatalf("OpenFileContext returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	close(h.release)
+
+	select {
+	case <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handle opened after the request was abandoned has not been closed")
+	}
+}
+
+func TestListContext(t *testing.T) {
+	cli := newLoopback(t)
+
+	if err := cli.MkDir("/dir", nil); err != nil {
+		t.Fatalf("MkDir: %s", err)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := cli.MkDir("/dir/"+name, nil); err != nil {
+			t.Fatalf("MkDir: %s", err)
+		}
+	}
+
+	list, err := cli.ListContext(context.Background(), "/dir")
+	if err != nil {
+		t.Fatalf("ListContext: %s", err)
+	}
+
+	if len(list) != 3 {
+		t.Errorf("ListContext returned %d entries, expected 3", len(list))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := cli.ListContext(ctx, "/dir"); err != context.Canceled {
+		t.Errorf("ListContext with a canceled context returned %v", err)
+	}
+}
+
+// closeHandler reports closing the file handle of /file on closed
+type closeHandler struct {
+	*MemoryHandler
+
+	closed chan struct{}
+}
+
+func (h *closeHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	f, err := h.MemoryHandler.Open(p, flag, attr)
+	if err != nil || p != "/file" {
+		return f, err
+	}
+
+	return &closeNotifyFile{f, h.closed}, nil
+}
+
+func TestClientClose(t *testing.T) {
+	h := &closeHandler{MemoryHandler: NewMemoryHandler(), closed: make(chan struct{})}
+	cli := newServerClient(t, h)
+
+	if _, err := cli.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+
+	if err := cli.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	select {
+	case <-h.closed:
+	default:
+		t.Error("Close did not close the open file handle")
+	}
+
+	if err := cli.Close(); err != nil {
+		t.Errorf("second Close returned %v", err)
+	}
+
+	if _, err := cli.Stat("/file"); err != ErrClosed {
+		t.Errorf("Stat after Close returned %v, expected ErrClosed", err)
+	}
+
+	select {
+	case <-cli.Done():
+	default:
+		t.Error("connection still alive after Close")
+	}
+}
+
+func TestClientShutdownExpired(t *testing.T) {
+	h := &closeHandler{MemoryHandler: NewMemoryHandler(), closed: make(chan struct{})}
+	cli := newServerClient(t, h)
+
+	if _, err := cli.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+
+	// the deadline for pending requests does not apply to closing handles
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := cli.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+
+	select {
+	case <-h.closed:
+	default:
+		t.Error("Shutdown with an expired context did not close the open file handle")
+	}
+
+	if err := cli.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown returned %v", err)
+	}
+}
+
+// serveHandshake answers the SSH_FXP_INIT of the client without advertising
+// extensions
+func serveHandshake(r io.Reader, w io.Writer) error {
+	if _, err := readPacket(r); err != nil {
+		return err
+	}
+
+	return writePacket(w, &sshfxp.Version{Version: 3})
+}
+
+func TestClientConnectionLost(t *testing.T) {
+	received := make(chan struct{})
+
+	cli, err := newRawClient(t, func(r io.Reader, w io.Writer) {
+		if err := serveHandshake(r, w); err != nil {
+			return
+		}
+
+		// drop the connection while a request is pending
+		readPacket(r)
+		close(received)
+	})
+	if err != nil {
+		t.Fatalf("NewClientPipe: %s", err)
+	}
+
+	if err := cli.Err(); err != nil {
+		t.Fatalf("Err returned %v for a live connection", err)
+	}
+
+	pending := make(chan error, 1)
+	go func() {
+		_, err := cli.Stat("/")
+		pending <- err
+	}()
+
+	<-received
+
+	var err1 error
+	select {
+	case err1 = <-pending:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending request did not fail after the connection was lost")
+	}
+
+	var lost *ConnectionLostError
+	if !errors.As(err1, &lost) {
+		t.Errorf("pending request returned %v, expected a *ConnectionLostError", err1)
+	}
+
+	select {
+	case <-cli.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done not closed after the connection was lost")
+	}
+
+	if err := cli.Err(); err != err1 {
+		t.Errorf("Err returned %v, expected %v", err, err1)
+	}
+
+	if _, err := cli.Stat("/"); err != err1 {
+		t.Errorf("request after the connection was lost returned %v, expected %v", err, err1)
+	}
+
+	if err := cli.Close(); err != err1 {
+		t.Errorf("Close returned %v, expected %v", err, err1)
+	}
+}
+
+func TestClientOversizedResponse(t *testing.T) {
+	cli, err := newRawClient(t, func(r io.Reader, w io.Writer) {
+		if err := serveHandshake(r, w); err != nil {
+			return
+		}
+
+		readPacket(r)
+
+		// the length of a packet far longer than any response
+		w.Write([]byte{0x40, 0, 0, 0, sshfxp.TypeData})
+		io.Copy(ioutil.Discard, r)
+	})
+	if err != nil {
+		t.Fatalf("NewClientPipe: %s", err)
+	}
+
+	_, err = cli.Stat("/")
+
+	var lost *ConnectionLostError
+	if !errors.As(err, &lost) {
+		t.Errorf("request answered by an oversized packet returned %v, expected a *ConnectionLostError", err)
+	}
+}
+
+func TestClientOptionValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		opt   ClientOption
+		valid bool
+	}{
+		{"MaxPacket(0)", MaxPacket(0), false},
+		{"MaxPacket(-1)", MaxPacket(-1), false},
+		{"MaxPacket(1)", MaxPacket(1), true},
+		{"MaxPacket(MaxPacketLimit)", MaxPacket(MaxPacketLimit), true},
+		{"MaxPacket(MaxPacketLimit+1)", MaxPacket(MaxPacketLimit + 1), false},
+		{"MaxConcurrentRequests(0)", MaxConcurrentRequests(0), false},
+		{"MaxConcurrentRequests(1)", MaxConcurrentRequests(1), true},
+		{"HandshakeTimeout(-1)", HandshakeTimeout(-1), false},
+		{"HandshakeTimeout(0)", HandshakeTimeout(0), true},
+		{"WithLogger(nil)", WithLogger(nil), false},
+		{"RequestExtension without name", RequestExtension("", "1"), false},
+	}
+
+	for _, test := range tests {
+		_, err := newRawClient(t, func(r io.Reader, w io.Writer) {
+			if err := serveHandshake(r, w); err != nil {
+				return
+			}
+
+			io.Copy(ioutil.Discard, r)
+		}, test.opt)
+
+		if test.valid && err != nil {
+			t.Errorf("%s: NewClientPipe: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: NewClientPipe accepted an invalid option", test.name)
+		}
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	start := time.Now()
+
+	_, err := newRawClient(t, func(r io.Reader, w io.Writer) {
+		// never answer SSH_FXP_INIT
+		io.Copy(ioutil.Discard, r)
+	}, HandshakeTimeout(50*time.Millisecond))
+
+	if err == nil {
+		t.Fatal("NewClientPipe succeeded without a server version")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("handshake failed after %s, expected 50ms", elapsed)
+	}
+}
+
+func TestClientSymlinkOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []ClientOption
+		expected sshfxp.Symlink
+	}{
+		{"default", nil, sshfxp.Symlink{LinkPath: "/target", TargetPath: "/link"}},
+		{"SymlinkOpenSSH", []ClientOption{WithSymlinkOrder(SymlinkOpenSSH)}, sshfxp.Symlink{LinkPath: "/target", TargetPath: "/link"}},
+		{"SymlinkStandard", []ClientOption{WithSymlinkOrder(SymlinkStandard)}, sshfxp.Symlink{LinkPath: "/link", TargetPath: "/target"}},
+	}
+
+	for _, test := range tests {
+		requests := make(chan *sshfxp.Symlink, 1)
+
+		cli, err := newRawClient(t, func(r io.Reader, w io.Writer) {
+			if err := serveHandshake(r, w); err != nil {
+				return
+			}
+
+			msg, err := readPacket(r)
+			if err != nil {
+				return
+			}
+
+			symlink, _ := msg.(*sshfxp.Symlink)
+			requests <- symlink
+
+			if symlink != nil {
+				writePacket(w, &sshfxp.Status{ID: symlink.ID, Error: sshfxp.StatusOK})
+			}
+
+			io.Copy(ioutil.Discard, r)
+		}, test.opts...)
+		if err != nil {
+			t.Fatalf("%s: NewClientPipe: %s", test.name, err)
+		}
+
+		if err := cli.Symlink("/target", "/link"); err != nil {
+			t.Errorf("%s: Symlink: %s", test.name, err)
+		}
+
+		req := <-requests
+		if req == nil {
+			t.Errorf("%s: server did not receive SSH_FXP_SYMLINK", test.name)
+		} else if req.LinkPath != test.expected.LinkPath || req.TargetPath != test.expected.TargetPath {
+			t.Errorf("%s: server received linkpath %q and targetpath %q, expected %q and %q",
+				test.name, req.LinkPath, req.TargetPath, test.expected.LinkPath, test.expected.TargetPath)
+		}
+	}
+
+	if _, err := newRawClient(t, func(r io.Reader, w io.Writer) {}, WithSymlinkOrder(SymlinkOrder(42))); err == nil {
+		t.Error("NewClientPipe accepted an invalid symlink order")
+	}
+}
+
+func TestClientSymlinkLoopback(t *testing.T) {
+	cli := newLoopback(t)
+
+	putFile(t, cli, "/target", "data")
+
+	if err := cli.Symlink("/target", "/link"); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	if target, err := cli.ReadLink("/link"); err != nil || target != "/target" {
+		t.Errorf("ReadLink returned %q, %v, expected /target", target, err)
+	}
+
+	if fi, err := cli.Lstat("/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat of the link returned %v, %v", fi, err)
+	}
+}
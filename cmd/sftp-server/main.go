@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/alecthomas/kingpin"
+	"github.com/nethack42/go-sftp"
+)
+
+var (
+	logLevel  = kingpin.Flag("log-level", "Log level (QUIET, FATAL, ERROR, INFO, VERBOSE, DEBUG, DEBUG1-3)").Short('l').Default("ERROR").String()
+	logStderr = kingpin.Flag("stderr", "Log to stderr. Logging is disabled otherwise").Short('e').Bool()
+	readOnly  = kingpin.Flag("read-only", "Reject all requests modifying the file system").Short('R').Bool()
+	umask     = kingpin.Flag("umask", "Octal umask applied to created files and directories").Short('u').String()
+	startDir  = kingpin.Flag("start-directory", "Directory, as seen by clients, relative paths are resolved against. %d is replaced by the home directory and %u by the user name").Short('d').String()
+	rootDir   = kingpin.Flag("root", "Directory served to clients. Clients can not access files outside of it").Default("/").String()
+)
+
+// parseLevel converts the log levels known from OpenSSH's sftp-server into
+// logrus levels
+func parseLevel(level string) (logrus.Level, error) {
+	switch strings.ToUpper(level) {
+	case "QUIET":
+		return logrus.PanicLevel, nil
+	case "VERBOSE":
+		return logrus.InfoLevel, nil
+	case "DEBUG1", "DEBUG2", "DEBUG3":
+		return logrus.DebugLevel, nil
+	default:
+		return logrus.ParseLevel(strings.ToLower(level))
+	}
+}
+
+// expandStartDir replaces %d with the home directory and %u with the name of
+// the current user, like OpenSSH's sftp-server does
+func expandStartDir(dir string) string {
+	u, err := user.Current()
+	if err != nil {
+		return dir
+	}
+
+	return strings.NewReplacer("%d", u.HomeDir, "%u", u.Username, "%%", "%").Replace(dir)
+}
+
+func main() {
+	kingpin.Parse()
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	if *logStderr {
+		log.Out = os.Stderr
+	}
+
+	level, err := parseLevel(*logLevel)
+	if err != nil {
+		kingpin.Fatalf("invalid log level %q", *logLevel)
+	}
+
+	log.Level = level
+
+	var opts []sftp.LocalOption
+
+	if *umask != "" {
+		mask, err := strconv.ParseUint(*umask, 8, 32)
+		if err != nil {
+			kingpin.Fatalf("invalid umask %q", *umask)
+		}
+
+		opts = append(opts, sftp.WithUmask(os.FileMode(mask)))
+	}
+
+	switch {
+	case *startDir != "":
+		opts = append(opts, sftp.WithStartDirectory(expandStartDir(*startDir)))
+
+	case *rootDir == "/":
+		// OpenSSH starts in the home directory of the user
+		if home, err := os.UserHomeDir(); err == nil {
+			opts = append(opts, sftp.WithStartDirectory(home))
+		}
+	}
+
+	handler, err := sftp.NewLocalHandler(*rootDir, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer handler.Close()
+
+	srvOpts := []sftp.ServerOption{
+		sftp.WithServerLogger(log),
+	}
+
+	if *readOnly {
+		srvOpts = append(srvOpts, sftp.ReadOnly())
+	}
+
+	srv, err := sftp.NewServer(os.Stdin, os.Stdout, handler, srvOpts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("serving %s", *rootDir)
+
+	if err := srv.Serve(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -22,6 +24,13 @@ var (
 	debugServer  = kingpin.Flag("server", "Path to SFTP server binary").Short('D').String()
 	debug        = kingpin.Flag("debug", "Enable debugging").Bool()
 	debugPackets = kingpin.Flag("dump-packets", "Dump packets sent between SFTP client and server").Bool()
+
+	identityFile    = kingpin.Flag("identity", "Private key used for public key authentication").Short('i').String()
+	knownHostsFile  = kingpin.Flag("known-hosts", "Path to the known_hosts file (default ~/.ssh/known_hosts)").String()
+	insecureHostKey = kingpin.Flag("insecure", "Do not verify the host key of the server").Bool()
+	sftpCommand     = kingpin.Flag("sftp-command", "Run this command on the remote host instead of requesting the sftp subsystem").String()
+
+	destination = kingpin.Arg("destination", "Remote host to connect to as [user@]host[:port]").String()
 )
 
 func startServer(ctx context.Context) *sftp.Client {
@@ -53,9 +62,9 @@ func startServer(ctx context.Context) *sftp.Client {
 		logrus.Fatal(err)
 	}
 
-	cli := sftp.NewClient(stdout, stdin)
-	if cli == nil {
-		logrus.Fatal(errors.New("NewClient returned nil"))
+	cli, err := sftp.NewClientPipe(stdout, stdin, sftp.HandshakeTimeout(10*time.Second))
+	if err != nil {
+		logrus.Fatal(err)
 	}
 
 	return cli
@@ -72,10 +81,17 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cli := startServer(ctx)
-	if cli == nil {
-		panic("cli is nil")
+	var cli *sftp.Client
+
+	switch {
+	case *destination != "":
+		cli = dialServer(*destination)
+	case *debugServer != "":
+		cli = startServer(ctx)
+	default:
+		kingpin.Fatalf("either a destination or --server is required")
 	}
+	defer cli.Close()
 
 	rl, err := readline.NewEx(&readline.Config{
 		Prompt:          "\033[32;1msftp)»\033[0m ",
@@ -127,6 +143,7 @@ var calls = map[string]Command{
 	"cat":   Command{cat, lsCompleter, nil},
 	"get":   Command{get, nil, nil},
 	"put":   Command{put, nil, nil},
+	"chmod": Command{chmod, nil, nil},
 }
 
 func buildCompleter(cli *sftp.Client) *readline.PrefixCompleter {
@@ -294,21 +311,21 @@ func listDirectory(cli *sftp.Client, params []string) error {
 		logrus.Error(err)
 		return nil
 	}
-	defer cli.Close(handle)
+	defer cli.CloseHandle(handle)
 
-	ls, err := cli.ReadDir(handle)
-	if err != nil {
-		logrus.Error(err)
-		return nil
-	}
-
-	for _, name := range ls {
+	dr := cli.DirReader(handle)
+	for dr.Next() {
+		name := dr.FileInfo()
 		if name.Name() == "." || name.Name() == ".." {
 			continue
 		}
 		fmt.Printf("\033[1m%s\033[0m\n", name.Name())
 	}
 
+	if err := dr.Err(); err != nil {
+		logrus.Error(err)
+	}
+
 	return nil
 }
 
@@ -386,6 +403,7 @@ func cat(cli *sftp.Client, params []string) error {
 		logrus.Error(err)
 		return nil
 	}
+	defer reader.Close()
 
 	io.Copy(os.Stderr, reader)
 
@@ -413,3 +431,24 @@ func put(cli *sftp.Client, params []string) error {
 
 	return cli.Put(local, remote)
 }
+
+func chmod(cli *sftp.Client, params []string) error {
+	if len(params) < 2 {
+		log.Println("Missing parameter. Usage: chmod [mode] [path]")
+		return nil
+	}
+
+	mode, err := strconv.ParseUint(params[0], 8, 32)
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+
+	path := params[1]
+
+	if err := cli.Chmod(path, sftp.ToFileMode(uint32(mode))); err != nil {
+		logrus.Error(err)
+	}
+
+	return nil
+}
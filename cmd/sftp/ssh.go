@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/chzyer/readline"
+	"github.com/nethack42/go-sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// splitDestination splits [user@]host[:port] into a user name and an address
+// suitable for net.Dial
+func splitDestination(dest string) (string, string) {
+	var username string
+
+	if idx := strings.LastIndex(dest, "@"); idx >= 0 {
+		username, dest = dest[:idx], dest[idx+1:]
+	}
+
+	if username == "" {
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		dest = net.JoinHostPort(dest, "22")
+	}
+
+	return username, dest
+}
+
+// authMethods returns the authentication methods to try in order: keys from
+// the SSH agent, the identity file and finally an interactive password prompt
+func authMethods(username, addr string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			logrus.Debugf("failed to connect to SSH agent: %s", err)
+		}
+	}
+
+	if *identityFile != "" {
+		signer, err := loadIdentity(*identityFile)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	methods = append(methods, ssh.PasswordCallback(func() (string, error) {
+		pw, err := readline.Password(fmt.Sprintf("%s@%s's password: ", username, addr))
+		return string(pw), err
+	}))
+
+	return methods
+}
+
+func loadIdentity(path string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		var passphrase []byte
+
+		passphrase, err = readline.Password(fmt.Sprintf("Enter passphrase for key '%s': ", path))
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity %s: %s", path, err)
+	}
+
+	return signer, nil
+}
+
+func hostKeyCallback() ssh.HostKeyCallback {
+	if *insecureHostKey {
+		logrus.Warnf("host key verification disabled")
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	path := *knownHostsFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	return callback
+}
+
+func dialServer(dest string) *sftp.Client {
+	username, addr := splitDestination(dest)
+
+	config := &ssh.ClientConfig{
+		User:            username,
+		Auth:            authMethods(username, addr),
+		HostKeyCallback: hostKeyCallback(),
+		Timeout:         10 * time.Second,
+	}
+
+	opts := []sftp.ClientOption{
+		sftp.HandshakeTimeout(10 * time.Second),
+	}
+
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var cli *sftp.Client
+	if *sftpCommand != "" {
+		cli, err = sftp.NewClientFromSSHCommand(conn, *sftpCommand, opts...)
+	} else {
+		cli, err = sftp.NewClientFromSSH(conn, opts...)
+	}
+
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	go func() {
+		<-cli.Done()
+		conn.Close()
+	}()
+
+	return cli
+}
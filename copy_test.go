@@ -0,0 +1,243 @@
+package sftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// putFile creates the remote file p with content data
+func putFile(t *testing.T, cli *Client, p, data string) {
+	t.Helper()
+
+	f, err := cli.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+
+	if _, err := f.Write([]byte(data)); err != nil {
+		f.Close()
+		t.Fatalf("Write: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+// getFile returns the content of the remote file p
+func getFile(t *testing.T, cli *Client, p string) string {
+	t.Helper()
+
+	r, err := cli.FileReader(p)
+	if err != nil {
+		t.Fatalf("FileReader: %s", err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+
+	return string(data)
+}
+
+// testCopyToLink copies /src onto link, which must refer to /src, and checks
+// that the copy fails without damaging /src
+func testCopyToLink(t *testing.T, cli *Client, link string) {
+	t.Helper()
+
+	if err := cli.CopyFile("/src", link, true); err == nil {
+		t.Errorf("copying /src onto %s succeeded", link)
+	}
+
+	if data := getFile(t, cli, "/src"); data != "source data" {
+		t.Errorf("copying /src onto %s changed it to %q", link, data)
+	}
+}
+
+func TestCopyFileToSymlink(t *testing.T) {
+	cli := newLoopback(t)
+
+	putFile(t, cli, "/src", "source data")
+
+	if err := cli.Symlink("/src", "/link"); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	testCopyToLink(t, cli, "/link")
+}
+
+// rejectCopy returns server options advertising copy-file and copy-data but
+// answering all requests with SSH_FX_OP_UNSUPPORTED. calls counts the
+// rejected requests
+func rejectCopy(calls *int32) []ServerOption {
+	reject := func(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+		atomic.AddInt32(calls, 1)
+		return nil, ErrUnsupported
+	}
+
+	return []ServerOption{
+		HandleExtension(sshfxp.ExtCopyFile, "1", reject),
+		HandleExtension(sshfxp.ExtCopyData, "1", reject),
+	}
+}
+
+// testCopyFile copies a file larger than a single request with and without
+// replacing the destination
+func testCopyFile(t *testing.T, cli *Client) {
+	t.Helper()
+
+	data := string(bytes.Repeat([]byte("0123456789"), 100000))
+
+	putFile(t, cli, "/src", data)
+
+	if err := cli.Chmod("/src", 0600); err != nil {
+		t.Fatalf("Chmod: %s", err)
+	}
+
+	if err := cli.CopyFile("/src", "/dst", false); err != nil {
+		t.Fatalf("CopyFile: %s", err)
+	}
+
+	if getFile(t, cli, "/dst") != data {
+		t.Error("the copy differs from the source")
+	}
+
+	if fi, err := cli.Stat("/dst"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("the copy has mode %v, %v, expected the permissions of the source", fi.Mode(), err)
+	}
+
+	if err := cli.CopyFile("/src", "/dst", false); err == nil {
+		t.Error("CopyFile replaced an existing file without overwrite")
+	}
+
+	putFile(t, cli, "/src", "short")
+
+	if err := cli.CopyFile("/src", "/dst", true); err != nil {
+		t.Fatalf("CopyFile with overwrite: %s", err)
+	}
+
+	if got := getFile(t, cli, "/dst"); got != "short" {
+		t.Errorf("replaced copy has %d bytes, expected %q", len(got), "short")
+	}
+}
+
+// testCopyRange copies a range between two files
+func testCopyRange(t *testing.T, cli *Client) {
+	t.Helper()
+
+	putFile(t, cli, "/src", "0123456789abcdefghijklmnopqrstuvwxyz")
+
+	src, err := cli.OpenFile("/src", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer src.Close()
+
+	dst, err := cli.OpenFile("/dst", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer dst.Close()
+
+	if err := cli.CopyRange(src.Handle(), 10, 6, dst.Handle(), 2); err != nil {
+		t.Fatalf("CopyRange: %s", err)
+	}
+
+	if err := cli.CopyRange(src.Handle(), 30, 0, dst.Handle(), 8); err != nil {
+		t.Fatalf("CopyRange until the end of the source: %s", err)
+	}
+
+	if got := getFile(t, cli, "/dst"); got != "\x00\x00abcdefuvwxyz" {
+		t.Errorf("destination holds %q", got)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	testCopyFile(t, newLoopback(t))
+}
+
+func TestCopyFileFallback(t *testing.T) {
+	var calls int32
+	cli := newServerClient(t, NewMemoryHandler(), rejectCopy(&calls)...)
+
+	testCopyFile(t, cli)
+
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Error("the client did not try the advertised extensions")
+	}
+}
+
+func TestCopyFileFallbackToSymlink(t *testing.T) {
+	var calls int32
+	cli := newServerClient(t, NewMemoryHandler(), rejectCopy(&calls)...)
+
+	putFile(t, cli, "/src", "source data")
+
+	if err := cli.Symlink("/src", "/link"); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	// the client can not tell that /link is /src, but must not destroy it
+	cli.CopyFile("/src", "/link", true)
+
+	if data := getFile(t, cli, "/src"); data != "source data" {
+		t.Errorf("copying /src onto /link changed it to %q", data)
+	}
+}
+
+func TestCopyRange(t *testing.T) {
+	testCopyRange(t, newLoopback(t))
+}
+
+func TestCopyRangeFallback(t *testing.T) {
+	var calls int32
+	cli := newServerClient(t, NewMemoryHandler(), rejectCopy(&calls)...)
+
+	testCopyRange(t, cli)
+
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Error("the client did not try the advertised extension")
+	}
+}
+
+func TestServerCopyDataSameHandle(t *testing.T) {
+	cli := newLoopback(t)
+
+	putFile(t, cli, "/file", "0123456789")
+
+	f, err := cli.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	for _, r := range []struct{ src, length, dst uint64 }{
+		{0, 5, 3},
+		{3, 5, 0},
+		{0, 0, 9},
+	} {
+		err := cli.CopyRange(f.Handle(), r.src, r.length, f.Handle(), r.dst)
+		if code, _ := statusCodeOf(err); code != sshfxp.StatusFailure {
+			t.Errorf("overlapping copy %v returned %v, expected SSH_FX_FAILURE", r, err)
+		}
+	}
+
+	if err := cli.CopyRange(f.Handle(), 1<<63, 1, f.Handle(), 0); err == nil {
+		t.Error("copy from offset 1<<63 succeeded")
+	}
+
+	if err := cli.CopyRange(f.Handle(), 0, 5, f.Handle(), 5); err != nil {
+		t.Fatalf("CopyRange of adjacent ranges: %s", err)
+	}
+
+	if got := getFile(t, cli, "/file"); got != "0123401234" {
+		t.Errorf("file holds %q after copying within it", got)
+	}
+}
@@ -0,0 +1,78 @@
+package sftp
+
+import (
+	"os"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// DirReader iterates over the entries of a remote directory. Entries are
+// requested from the server in batches as the iteration proceeds so even
+// huge directories can be processed without buffering all entries.
+//
+//	dr := cli.DirReader(handle)
+//	for dr.Next() {
+//		fmt.Println(dr.FileInfo().Name())
+//	}
+//	if err := dr.Err(); err != nil {
+//		...
+//	}
+type DirReader struct {
+	readDir func(handle string) ([]os.FileInfo, error)
+
+	handle string
+
+	batch   []os.FileInfo
+	current os.FileInfo
+	err     error
+	done    bool
+}
+
+// Next advances the iterator to the next directory entry which is then
+// available using FileInfo. It returns false if there are no more entries or
+// an error occured
+func (dr *DirReader) Next() bool {
+	for len(dr.batch) == 0 {
+		if dr.done {
+			dr.current = nil
+			return false
+		}
+
+		batch, err := dr.readDir(dr.handle)
+		if err != nil {
+			if !sshfxp.IsEOF(err) {
+				dr.err = err
+			}
+
+			dr.done = true
+			continue
+		}
+
+		dr.batch = batch
+	}
+
+	dr.current, dr.batch = dr.batch[0], dr.batch[1:]
+
+	return true
+}
+
+// FileInfo returns the current directory entry
+func (dr *DirReader) FileInfo() os.FileInfo {
+	return dr.current
+}
+
+// Err returns the first error encountered during iteration. Reaching the end
+// of the directory is not considered an error
+func (dr *DirReader) Err() error {
+	return dr.err
+}
+
+// NewDirReader returns a DirReader iterating over the directory identified by
+// handle. The handle must have been acquired previously by calling OpenDir()
+// and is not closed by the DirReader
+func NewDirReader(handle string, cli ClientConn) *DirReader {
+	return &DirReader{
+		readDir: cli.ReadDir,
+		handle:  handle,
+	}
+}
@@ -0,0 +1,56 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// ErrClosed is returned for requests issued after the client has been closed
+var ErrClosed = errors.New("sftp: client closed")
+
+// ConnectionLostError is returned for all pending and future requests once the
+// connection to the SFTP server failed. Err holds the underlying transport or
+// protocol error
+type ConnectionLostError struct {
+	Err error
+}
+
+func (e *ConnectionLostError) Error() string {
+	return fmt.Sprintf("sftp: connection lost: %s", e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ConnectionLostError) Unwrap() error {
+	return e.Err
+}
+
+// ExtensionUnsupportedError is returned by methods relying on a protocol
+// extension the server did not advertise. It matches ErrUnsupported when
+// checked with errors.Is
+type ExtensionUnsupportedError struct {
+	Name string
+}
+
+func (e *ExtensionUnsupportedError) Error() string {
+	return fmt.Sprintf("sftp: server does not support extension %s", e.Name)
+}
+
+// Unwrap returns ErrUnsupported
+func (e *ExtensionUnsupportedError) Unwrap() error {
+	return ErrUnsupported
+}
+
+// isUnsupported returns true if err reports that the server does not support
+// an operation, either because it did not advertise the extension or because
+// it answered with SSH_FX_OP_UNSUPPORTED
+func isUnsupported(err error) bool {
+	var unsupported *ExtensionUnsupportedError
+	if errors.As(err, &unsupported) {
+		return true
+	}
+
+	var statusErr *sshfxp.FxpStatusError
+	return errors.As(err, &statusErr) && statusErr.Code == sshfxp.StatusOpUnsupported
+}
@@ -0,0 +1,316 @@
+package sftp
+
+import (
+	"io"
+	"math"
+	"os"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// errReadOnly is returned by extension handlers modifying the file system if
+// the server is read-only
+var errReadOnly = &sshfxp.FxpStatusError{
+	Code:    sshfxp.StatusPermissionDenied,
+	Message: "read-only server",
+}
+
+// builtinExtensions registers the handlers of the extensions supported by
+// the server's handler unless they have been registered by options
+func (srv *Server) builtinExtensions() {
+	if _, ok := srv.handler.(PosixRenamer); ok {
+		srv.builtinExtension(sshfxp.ExtPosixRename, "1", handlePosixRename)
+	}
+
+	if _, ok := srv.handler.(Linker); ok {
+		srv.builtinExtension(sshfxp.ExtHardlink, "1", handleHardlink)
+	}
+
+	srv.builtinExtension(sshfxp.ExtLimits, "1", handleLimits)
+	srv.builtinExtension(sshfxp.ExtCopyData, "1", handleCopyData)
+	srv.builtinExtension(sshfxp.ExtCopyFile, "1", handleCopyFile)
+
+	// whether a file supports fsync@openssh.com is only known once it is
+	// opened, so the extension is always advertised like OpenSSH does
+	srv.builtinExtension(sshfxp.ExtFSync, "1", handleFSync)
+
+	if _, ok := srv.handler.(StatVFSHandler); ok {
+		srv.builtinExtension(sshfxp.ExtStatVFS, "2", handleStatVFS)
+		srv.builtinExtension(sshfxp.ExtFStatVFS, "2", handleFStatVFS)
+	}
+}
+
+func (srv *Server) builtinExtension(name, data string, fn ExtensionHandler) {
+	if _, ok := srv.extHandlers[name]; ok {
+		return
+	}
+
+	HandleExtension(name, data, fn)(srv)
+}
+
+// handlePosixRename serves posix-rename@openssh.com
+func handlePosixRename(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	if srv.IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	payload, err := req.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	rename := payload.(*sshfxp.PosixRename)
+
+	return nil, srv.handler.(PosixRenamer).PosixRename(rename.OldPath, rename.NewPath)
+}
+
+// handleLimits serves limits@openssh.com. The server does not limit the
+// number of open handles
+func handleLimits(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	return &sshfxp.Limits{
+		MaxPacketLength: uint64(maxPacketLength()),
+		MaxReadLength:   uint64(DefaultMaxReadLength),
+		MaxWriteLength:  uint64(DefaultMaxWriteLength),
+	}, nil
+}
+
+// handleHardlink serves hardlink@openssh.com
+func handleHardlink(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	if srv.IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	payload, err := req.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	link := payload.(*sshfxp.Hardlink)
+
+	return nil, srv.handler.(Linker).Link(link.OldPath, link.NewPath)
+}
+
+// handleFSync serves fsync@openssh.com
+func handleFSync(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	payload, err := req.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := srv.File(payload.(*sshfxp.FSync).Handle)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := f.(SyncHandle)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	return nil, s.Sync()
+}
+
+// handleStatVFS serves statvfs@openssh.com
+func handleStatVFS(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	payload, err := req.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := srv.handler.(StatVFSHandler).StatVFS(payload.(*sshfxp.StatVFSPath).Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return (*sshfxp.StatVFS)(st), nil
+}
+
+// handleFStatVFS serves fstatvfs@openssh.com
+func handleFStatVFS(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	payload, err := req.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := srv.getHandle(payload.(*sshfxp.StatVFSHandle).Handle)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := h.(StatVFSHandle)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	st, err := f.StatVFS()
+	if err != nil {
+		return nil, err
+	}
+
+	return (*sshfxp.StatVFS)(st), nil
+}
+
+// handleCopyData serves copy-data
+func handleCopyData(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	if srv.IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	payload, err := req.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	cp := payload.(*sshfxp.CopyData)
+
+	if cp.ReadOffset > math.MaxInt64 || cp.WriteOffset > math.MaxInt64 || cp.Length > math.MaxInt64 {
+		return nil, &sshfxp.FxpStatusError{
+			Code:    sshfxp.StatusFailure,
+			Message: "invalid offset or length",
+		}
+	}
+
+	if cp.ReadHandle == cp.WriteHandle && overlaps(cp.ReadOffset, cp.WriteOffset, cp.Length) {
+		return nil, &sshfxp.FxpStatusError{
+			Code:    sshfxp.StatusFailure,
+			Message: "source and destination ranges overlap",
+		}
+	}
+
+	src, err := srv.File(cp.ReadHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := srv.File(cp.WriteHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, copyData(dst, int64(cp.WriteOffset), src, int64(cp.ReadOffset), int64(cp.Length))
+}
+
+// overlaps returns true if the ranges of length bytes starting at a and b
+// overlap. A zero length extends the ranges to the end of the file
+func overlaps(a, b, length uint64) bool {
+	if length == 0 {
+		return true
+	}
+
+	return a < b+length && b < a+length
+}
+
+// handleCopyFile serves copy-file using the Handler of the server. The
+// destination is created with the permissions of the source
+func handleCopyFile(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+	if srv.IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	payload, err := req.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	cp := payload.(*sshfxp.CopyFile)
+	h := srv.handler
+
+	src, err := h.Open(cp.Source, os.O_RDONLY, FileAttr{})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "copy", Path: cp.Source, Err: errIsDir}
+	}
+
+	errSameFile := &sshfxp.FxpStatusError{
+		Code:    sshfxp.StatusFailure,
+		Message: "source and destination are the same file",
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if !cp.Overwrite {
+		flag |= os.O_EXCL
+	} else if samePath(h, cp.Source, cp.Destination) {
+		return nil, errSameFile
+	}
+
+	// the destination is truncated only after making sure that it is not
+	// the source, e.g. reached through a symbolic or hard link
+	dst, err := h.Open(cp.Destination, flag, FileAttr{HasMode: true, Mode: fi.Mode().Perm()})
+	if err != nil {
+		return nil, err
+	}
+
+	dfi, err := dst.Stat()
+	if err != nil {
+		dst.Close()
+		return nil, err
+	}
+
+	if sameFile(fi, dfi) {
+		dst.Close()
+		return nil, errSameFile
+	}
+
+	if err := dst.SetStat(FileAttr{HasSize: true}); err != nil {
+		dst.Close()
+		return nil, err
+	}
+
+	if err := copyData(dst, 0, src, 0, 0); err != nil {
+		dst.Close()
+		return nil, err
+	}
+
+	return nil, dst.Close()
+}
+
+// fileIdentity is implemented by file information of the built-in handlers
+// which os.SameFile can not compare
+type fileIdentity interface {
+	sameFile(os.FileInfo) bool
+}
+
+// sameFile returns true if a and b describe the same file. File information
+// of other handlers is compared using os.SameFile
+func sameFile(a, b os.FileInfo) bool {
+	if id, ok := a.(fileIdentity); ok {
+		return id.sameFile(b)
+	}
+
+	return os.SameFile(a, b)
+}
+
+// samePath returns true if h resolves a and b to the same path
+func samePath(h Handler, a, b string) bool {
+	ra, err := h.RealPath(a)
+	if err != nil {
+		return false
+	}
+
+	rb, err := h.RealPath(b)
+	if err != nil {
+		return false
+	}
+
+	return ra == rb
+}
+
+// copyData copies length bytes from src at srcOffset to dst at dstOffset. A
+// zero length copies until the end of src
+func copyData(dst io.WriterAt, dstOffset int64, src io.ReaderAt, srcOffset, length int64) error {
+	if length == 0 {
+		length = math.MaxInt64 - srcOffset
+	}
+
+	_, err := io.Copy(io.NewOffsetWriter(dst, dstOffset), io.NewSectionReader(src, srcOffset, length))
+	return err
+}
@@ -0,0 +1,273 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+func TestClientExtensionNegotiation(t *testing.T) {
+	inits := make(chan *sshfxp.Init, 1)
+
+	cli, err := newRawClient(t, func(r io.Reader, w io.Writer) {
+		msg, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		inits <- msg.(*sshfxp.Init)
+
+		writePacket(w, &sshfxp.Version{
+			Version: 3,
+			Extensions: []struct {
+				Name string
+				Data string
+			}{
+				{"foo@example.com", "1"},
+				{"bar@example.com", ""},
+			},
+		})
+
+		io.Copy(ioutil.Discard, r)
+	}, RequestExtension("client@example.com", "2"))
+	if err != nil {
+		t.Fatalf("NewClientPipe: %s", err)
+	}
+
+	init := <-inits
+	if len(init.Extensions) != 1 || init.Extensions[0].Name != "client@example.com" || init.Extensions[0].Data != "2" {
+		t.Errorf("client requested extensions %v", init.Extensions)
+	}
+
+	expected := map[string]string{"foo@example.com": "1", "bar@example.com": ""}
+	if extensions := cli.Extensions(); !reflect.DeepEqual(extensions, expected) {
+		t.Errorf("Extensions returned %v, expected %v", extensions, expected)
+	}
+
+	if data, ok := cli.HasExtension("foo@example.com"); !ok || data != "1" {
+		t.Errorf("HasExtension(foo@example.com) returned %q, %t", data, ok)
+	}
+
+	if _, ok := cli.HasExtension("bar@example.com"); !ok {
+		t.Error("extension with empty data is not reported")
+	}
+
+	if _, ok := cli.HasExtension(sshfxp.ExtLimits); ok {
+		t.Error("HasExtension reported an extension not advertised by the server")
+	}
+
+	// the returned map is a copy
+	cli.Extensions()["baz@example.com"] = "1"
+	if _, ok := cli.HasExtension("baz@example.com"); ok {
+		t.Error("modifying the result of Extensions changed the client")
+	}
+}
+
+func TestServerAdvertisedExtensions(t *testing.T) {
+	cli := newServerClient(t, NewMemoryHandler(), WithExtension("hello@example.com", "1"))
+
+	for _, name := range []string{
+		"hello@example.com",
+		sshfxp.ExtPosixRename,
+		sshfxp.ExtLimits,
+		sshfxp.ExtFSync,
+		sshfxp.ExtCopyData,
+		sshfxp.ExtCopyFile,
+	} {
+		if _, ok := cli.HasExtension(name); !ok {
+			t.Errorf("server did not advertise %s", name)
+		}
+	}
+
+	// MemoryHandler implements neither Linker nor StatVFSHandler
+	for _, name := range []string{sshfxp.ExtHardlink, sshfxp.ExtStatVFS, sshfxp.ExtFStatVFS} {
+		if _, ok := cli.HasExtension(name); ok {
+			t.Errorf("server advertised %s", name)
+		}
+	}
+}
+
+// greeting is the request and reply payload of greeting@example.com
+type greeting struct {
+	Text string
+}
+
+func (g *greeting) Write(w io.Writer) error {
+	_, err := io.WriteString(w, g.Text)
+	return err
+}
+
+func (g *greeting) Read(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	g.Text = string(data)
+	return err
+}
+
+func init() {
+	sshfxp.RegisterExtension("greeting@example.com",
+		func() sshfxp.Message { return &greeting{} },
+		func() sshfxp.Message { return &greeting{} })
+}
+
+func TestClientExtended(t *testing.T) {
+	cli := newServerClient(t, NewMemoryHandler(),
+		HandleExtension("greeting@example.com", "1", func(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+			payload, err := req.Payload()
+			if err != nil {
+				return nil, err
+			}
+
+			return &greeting{Text: "hello " + payload.(*greeting).Text}, nil
+		}),
+		HandleExtension("status@example.com", "1", func(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+			return nil, nil
+		}),
+		HandleExtension("raw@example.com", "1", func(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+			return &greeting{Text: "raw"}, nil
+		}),
+		HandleExtension("fail@example.com", "1", func(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+			return nil, os.ErrNotExist
+		}),
+	)
+
+	reply, err := cli.Extended("greeting@example.com", &greeting{Text: "alice"})
+	if err != nil {
+		t.Fatalf("Extended: %s", err)
+	}
+
+	if g, ok := reply.(*greeting); !ok || g.Text != "hello alice" {
+		t.Errorf("Extended returned %#v", reply)
+	}
+
+	// a SSH_FXP_STATUS response carries no reply
+	if reply, err := cli.Extended("status@example.com", nil); err != nil || reply != nil {
+		t.Errorf("Extended returned %#v, %v for a status response", reply, err)
+	}
+
+	// replies of unregistered extensions are returned undecoded
+	reply, err = cli.Extended("raw@example.com", nil)
+	if r, ok := reply.(*sshfxp.ExtendedReply); err != nil || !ok || string(r.Data) != "raw" {
+		t.Errorf("Extended returned %#v, %v for an unregistered reply", reply, err)
+	}
+
+	_, err = cli.Extended("fail@example.com", nil)
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusNoSuchFile {
+		t.Errorf("Extended returned %v, expected SSH_FX_NO_SUCH_FILE", err)
+	}
+
+	_, err = cli.Extended("unknown@example.com", nil)
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusOpUnsupported {
+		t.Errorf("Extended returned %v for an unknown extension, expected SSH_FX_OP_UNSUPPORTED", err)
+	}
+
+	// the connection survives failed extended requests
+	if _, err := cli.Stat("/"); err != nil {
+		t.Errorf("Stat after extended requests: %s", err)
+	}
+}
+
+// linkHandler records hard links instead of creating them
+type linkHandler struct {
+	*MemoryHandler
+
+	links [][2]string
+}
+
+func (h *linkHandler) Link(oldpath, newpath string) error {
+	if _, err := h.Lstat(oldpath); err != nil {
+		return err
+	}
+
+	h.links = append(h.links, [2]string{oldpath, newpath})
+	return nil
+}
+
+func TestClientLink(t *testing.T) {
+	h := &linkHandler{MemoryHandler: NewMemoryHandler()}
+	cli := newServerClient(t, h)
+
+	if _, ok := cli.HasExtension(sshfxp.ExtHardlink); !ok {
+		t.Fatal("server did not advertise hardlink@openssh.com")
+	}
+
+	putFile(t, cli, "/file", "data")
+
+	if err := cli.Link("/file", "/link"); err != nil {
+		t.Fatalf("Link: %s", err)
+	}
+
+	if len(h.links) != 1 || h.links[0] != [2]string{"/file", "/link"} {
+		t.Errorf("handler created links %v, expected /file to /link", h.links)
+	}
+
+	err := cli.Link("/missing", "/link")
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusNoSuchFile {
+		t.Errorf("Link of a missing file returned %v, expected SSH_FX_NO_SUCH_FILE", err)
+	}
+
+	ro := newServerClient(t, h, ReadOnly())
+
+	err = ro.Link("/file", "/other")
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusPermissionDenied {
+		t.Errorf("Link on a read-only server returned %v, expected SSH_FX_PERMISSION_DENIED", err)
+	}
+
+	if len(h.links) != 1 {
+		t.Errorf("handler created links %v", h.links)
+	}
+}
+
+func TestClientLinkUnsupported(t *testing.T) {
+	cli := newServerClient(t, NewMemoryHandler())
+
+	err := cli.Link("/file", "/link")
+
+	var unsupported *ExtensionUnsupportedError
+	if !errors.As(err, &unsupported) || unsupported.Name != sshfxp.ExtHardlink {
+		t.Errorf("Link returned %v, expected an *ExtensionUnsupportedError", err)
+	}
+}
+
+func TestFileSync(t *testing.T) {
+	h := &closeHandler{MemoryHandler: NewMemoryHandler(), closed: make(chan struct{})}
+	cli := newServerClient(t, h)
+
+	f, err := cli.OpenFile("/synced", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		t.Errorf("Sync: %s", err)
+	}
+
+	// the file handles of closeHandler do not implement SyncHandle
+	f, err = cli.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	err = f.Sync()
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusOpUnsupported {
+		t.Errorf("Sync of a handle without SyncHandle returned %v, expected SSH_FX_OP_UNSUPPORTED", err)
+	}
+
+	if err := cli.Fsync("no-such-handle"); err == nil {
+		t.Error("Fsync of an unknown handle succeeded")
+	}
+}
+
+func TestFileSyncUnsupported(t *testing.T) {
+	cli := newBareClient(t)
+
+	if err := cli.Fsync("handle"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Fsync returned %v, expected ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,345 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// File represents a remote file opened via Client.OpenFile. It implements
+// io.Reader, io.ReaderAt, io.Writer, io.WriterAt, io.Seeker and io.Closer
+type File struct {
+	cli ClientConn
+
+	path   string
+	handle string
+
+	readSize    int
+	writeSize   int
+	concurrency int
+
+	m      sync.Mutex
+	offset int64
+}
+
+var (
+	_ io.ReadWriteSeeker = &File{}
+	_ io.ReaderAt        = &File{}
+	_ io.WriterAt        = &File{}
+	_ io.Closer          = &File{}
+	_ io.ReaderFrom      = &File{}
+	_ io.WriterTo        = &File{}
+)
+
+func newFile(path, handle string, cli ClientConn, readSize, writeSize, concurrency int) *File {
+	return &File{
+		cli:         cli,
+		path:        path,
+		handle:      handle,
+		readSize:    readSize,
+		writeSize:   writeSize,
+		concurrency: concurrency,
+	}
+}
+
+// Name returns the path of the file as passed to OpenFile
+func (f *File) Name() string {
+	return f.path
+}
+
+// Handle returns the SFTP handle of the file
+func (f *File) Handle() string {
+	return f.handle
+}
+
+// Read reads up to len(p) bytes from the current offset of the file. It
+// returns io.EOF at the end of the file
+func (f *File) Read(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if len(p) > f.readSize {
+		p = p[:f.readSize]
+	}
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from the file starting at off. If less than len(p)
+// bytes have been read, a non-nil error is returned. Large reads are split into
+// multiple requests that are sent concurrently
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if len(p) <= f.readSize {
+		var n int
+		for n < len(p) {
+			m, err := f.readAt(p[n:], off+int64(n))
+			n += m
+
+			if err != nil {
+				return n, err
+			}
+		}
+
+		return n, nil
+	}
+
+	buf := &sliceWriter{buf: p}
+
+	n, err := readAhead(f.cli, f.handle, uint64(off), int64(len(p)), f.readSize, f.concurrency, buf)
+	if err == nil && int(n) < len(p) {
+		err = io.EOF
+	}
+
+	return int(n), err
+}
+
+// readAt issues a single read request. Servers may return less data than
+// requested
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	data, err := f.cli.Read(f.handle, uint64(off), uint32(len(p)))
+	if err != nil {
+		if sshfxp.IsEOF(err) {
+			return 0, io.EOF
+		}
+
+		return 0, err
+	}
+
+	if len(data) == 0 {
+		// end of file is reported with SSH_FX_EOF. Treating an empty
+		// reply as a short read would make ReadAt retry forever
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	return copy(p, data), nil
+}
+
+// Write writes len(p) bytes to the file at the current offset
+func (f *File) Write(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+// WriteAt writes len(p) bytes to the file starting at off. Large writes are
+// split into multiple requests that are sent concurrently
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if len(p) <= f.writeSize {
+		if err := f.cli.Write(f.handle, uint64(off), p); err != nil {
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
+	n, err := writeBehind(f.cli, f.handle, uint64(off), f.writeSize, f.concurrency, bytes.NewReader(p))
+
+	return int(n), err
+}
+
+// ReadFrom writes the contents of r to the file starting at the current offset
+// until r returns io.EOF. It implements io.ReaderFrom so io.Copy uses
+// concurrent write requests automatically
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	n, err := writeBehind(f.cli, f.handle, uint64(f.offset), f.writeSize, f.concurrency, r)
+	f.offset += n
+
+	return n, err
+}
+
+// WriteTo writes the contents of the file starting at the current offset to w
+// until the end of the file is reached. It implements io.WriterTo so io.Copy
+// uses concurrent read requests automatically
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	n, err := readAhead(f.cli, f.handle, uint64(f.offset), -1, f.readSize, f.concurrency, w)
+	f.offset += n
+
+	return n, err
+}
+
+// Seek sets the offset for the next Read or Write on the file. whence is one
+// of io.SeekStart, io.SeekCurrent or io.SeekEnd. Seeking relative to the end
+// of the file requires a round trip to the server
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		fi, err := f.cli.Fstat(f.handle)
+		if err != nil {
+			return f.offset, err
+		}
+
+		offset += fi.Size()
+	default:
+		return f.offset, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return f.offset, errors.New("negative offset")
+	}
+
+	f.offset = offset
+
+	return f.offset, nil
+}
+
+// Stat returns file information about the file
+func (f *File) Stat() (os.FileInfo, error) {
+	fi, err := f.cli.Fstat(f.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, ok := fi.(FileInfo); ok {
+		info.name = path.Base(f.path)
+		info.packet.Filename = info.name
+
+		return info, nil
+	}
+
+	return fi, nil
+}
+
+// Truncate changes the size of the file. The current offset is not changed
+func (f *File) Truncate(size int64) error {
+	return f.cli.Ftruncate(f.handle, size)
+}
+
+// Chmod changes the permission bits of the file
+func (f *File) Chmod(mode os.FileMode) error {
+	return f.cli.Fchmod(f.handle, mode)
+}
+
+// StatVFS returns statistics of the file system containing the file. It
+// requires the fstatvfs@openssh.com extension
+func (f *File) StatVFS() (*StatVFS, error) {
+	return f.cli.FStatVFS(f.handle)
+}
+
+// Sync commits the contents of the file to stable storage. It requires the
+// fsync@openssh.com extension and fails with an error matching
+// ErrUnsupported if the server does not support it
+func (f *File) Sync() error {
+	return f.cli.Fsync(f.handle)
+}
+
+// Close closes the file handle
+func (f *File) Close() error {
+	return f.cli.CloseHandle(f.handle)
+}
+
+// sliceWriter is an io.Writer that fills a fixed size buffer
+type sliceWriter struct {
+	buf []byte
+	n   int
+}
+
+func (sw *sliceWriter) Write(p []byte) (int, error) {
+	n := copy(sw.buf[sw.n:], p)
+	sw.n += n
+
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+// openFlags converts os.O_* flags into SSH_FXF_* flags
+func openFlags(flag int) uint32 {
+	var pflags uint32
+
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		pflags |= sshfxp.OpenRead
+	case os.O_WRONLY:
+		pflags |= sshfxp.OpenWrite
+	case os.O_RDWR:
+		pflags |= sshfxp.OpenRead | sshfxp.OpenWrite
+	}
+
+	if flag&os.O_APPEND != 0 {
+		pflags |= sshfxp.OpenAppend
+	}
+
+	if flag&os.O_CREATE != 0 {
+		pflags |= sshfxp.OpenCreate
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		pflags |= sshfxp.OpenTruncate
+	}
+
+	if flag&os.O_EXCL != 0 {
+		pflags |= sshfxp.OpenExcl
+	}
+
+	return pflags
+}
+
+// osFlags converts SSH_FXF_* flags into os.O_* flags
+func osFlags(pflags uint32) int {
+	var flag int
+
+	switch {
+	case pflags&sshfxp.OpenRead != 0 && pflags&sshfxp.OpenWrite != 0:
+		flag = os.O_RDWR
+	case pflags&sshfxp.OpenWrite != 0:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+
+	if pflags&sshfxp.OpenAppend != 0 {
+		flag |= os.O_APPEND
+	}
+
+	if pflags&sshfxp.OpenCreate != 0 {
+		flag |= os.O_CREATE
+	}
+
+	if pflags&sshfxp.OpenTruncate != 0 {
+		flag |= os.O_TRUNC
+	}
+
+	if pflags&sshfxp.OpenExcl != 0 {
+		flag |= os.O_EXCL
+	}
+
+	return flag
+}
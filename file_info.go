@@ -9,15 +9,48 @@ import (
 
 // FileInfo holds file and directory information and implements os.FileInfo
 type FileInfo struct {
-	name      string
-	size      int64
-	mode      os.FileMode
-	modtime   time.Time
-	directory bool
+	name    string
+	size    int64
+	mode    os.FileMode
+	modtime time.Time
+	atime   time.Time
+	uid     uint32
+	gid     uint32
 
 	packet sshfxp.NameInfo
 }
 
+// newFileInfo creates a FileInfo for name from the SFTP attributes in attr
+func newFileInfo(name string, attr sshfxp.Attr) FileInfo {
+	fi := FileInfo{
+		name: name,
+		packet: sshfxp.NameInfo{
+			Filename: name,
+			Attr:     attr,
+		},
+	}
+
+	if attr.Flags&sshfxp.FlagAttrSize > 0 {
+		fi.size = int64(attr.Size)
+	}
+
+	if attr.Flags&sshfxp.FlagAttrPermissions > 0 {
+		fi.mode = ToFileMode(attr.Permissions)
+	}
+
+	if attr.Flags&sshfxp.FlagAttrUidGid > 0 {
+		fi.uid = attr.UID
+		fi.gid = attr.GID
+	}
+
+	if attr.Flags&sshfxp.FlagAttrAcModTime > 0 {
+		fi.atime = time.Unix(int64(attr.ATime), 0)
+		fi.modtime = time.Unix(int64(attr.MTime), 0)
+	}
+
+	return fi
+}
+
 // Name returns the name of the directory or file
 func (fi FileInfo) Name() string {
 	return fi.name
@@ -28,8 +61,7 @@ func (fi FileInfo) Size() int64 {
 	return fi.size
 }
 
-// Mode returns the access mode for the file or directory
-// BUG: need to convert SFTP file modes to Golang os.FileMode
+// Mode returns the access mode and file type for the file or directory
 func (fi FileInfo) Mode() os.FileMode {
 	return fi.mode
 }
@@ -39,10 +71,24 @@ func (fi FileInfo) ModTime() time.Time {
 	return fi.modtime
 }
 
+// AccessTime returns the last access time of the file or directory
+func (fi FileInfo) AccessTime() time.Time {
+	return fi.atime
+}
+
+// UID returns the numeric user ID of the owner of the file or directory
+func (fi FileInfo) UID() uint32 {
+	return fi.uid
+}
+
+// GID returns the numeric group ID of the file or directory
+func (fi FileInfo) GID() uint32 {
+	return fi.gid
+}
+
 // IsDir returns true if the file is actually a directory
-// BUG: not yet implemented
 func (fi FileInfo) IsDir() bool {
-	return fi.directory
+	return fi.mode.IsDir()
 }
 
 // Sys returns the underlying SSH_FXP packet (sshfxp.NameInfo)
@@ -0,0 +1,283 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// ErrUnsupported may be returned by Handler implementations for operations
+// they do not support. It is reported to the client as
+// SSH_FX_OP_UNSUPPORTED
+var ErrUnsupported = errors.New("sftp: operation unsupported")
+
+// Handler serves the file system operations of a SFTP session. Paths are
+// passed as sent by the client and need to be resolved and checked by the
+// handler. Errors satisfying os.IsNotExist or os.IsPermission, io.EOF,
+// ErrUnsupported and *sshfxp.FxpStatusError are reported to the client with
+// the matching status code, all other errors as SSH_FX_FAILURE
+type Handler interface {
+	// Open opens the file at path. flag holds os.O_* flags. If the file is
+	// created, attr holds its initial attributes
+	Open(path string, flag int, attr FileAttr) (FileHandle, error)
+
+	// OpenDir opens the directory at path for reading its entries
+	OpenDir(path string) (DirHandle, error)
+
+	// Stat returns file information for path, following symbolic links
+	Stat(path string) (os.FileInfo, error)
+
+	// Lstat returns file information for path without following symbolic
+	// links
+	Lstat(path string) (os.FileInfo, error)
+
+	// SetStat changes the attributes of path selected in attr
+	SetStat(path string, attr FileAttr) error
+
+	// Remove removes the file at path
+	Remove(path string) error
+
+	// Rename renames oldpath to newpath. It must fail if newpath exists
+	Rename(oldpath, newpath string) error
+
+	// Mkdir creates the directory path with the attributes in attr
+	Mkdir(path string, attr FileAttr) error
+
+	// Rmdir removes the empty directory path
+	Rmdir(path string) error
+
+	// RealPath returns the canonical absolute form of path
+	RealPath(path string) (string, error)
+
+	// ReadLink returns the target of the symbolic link path
+	ReadLink(path string) (string, error)
+
+	// Symlink creates the symbolic link linkpath pointing to target
+	Symlink(target, linkpath string) error
+}
+
+// PosixRenamer is implemented by handlers supporting the
+// posix-rename@openssh.com extension. The server advertises the extension
+// only if its handler implements PosixRenamer
+type PosixRenamer interface {
+	// PosixRename renames oldpath to newpath, atomically replacing newpath
+	// if it exists
+	PosixRename(oldpath, newpath string) error
+}
+
+// Linker is implemented by handlers supporting the hardlink@openssh.com
+// extension
+type Linker interface {
+	// Link creates newpath as a hard link to oldpath
+	Link(oldpath, newpath string) error
+}
+
+// SyncHandle is implemented by file handles supporting the fsync@openssh.com
+// extension
+type SyncHandle interface {
+	// Sync commits the contents of the file to stable storage
+	Sync() error
+}
+
+// StatVFSHandler is implemented by handlers supporting the
+// statvfs@openssh.com extension. File and directory handles additionally
+// implementing StatVFSHandle support fstatvfs@openssh.com
+type StatVFSHandler interface {
+	// StatVFS returns statistics of the file system containing path
+	StatVFS(path string) (*StatVFS, error)
+}
+
+// StatVFSHandle is implemented by file and directory handles of a
+// StatVFSHandler
+type StatVFSHandle interface {
+	// StatVFS returns statistics of the file system containing the file
+	StatVFS() (*StatVFS, error)
+}
+
+// FileHandle is a file opened by Handler.Open
+type FileHandle interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	// Stat returns file information about the opened file
+	Stat() (os.FileInfo, error)
+
+	// SetStat changes the attributes of the opened file selected in attr
+	SetStat(attr FileAttr) error
+}
+
+// DirHandle is a directory opened by Handler.OpenDir
+type DirHandle interface {
+	io.Closer
+
+	// ReadDir returns up to n directory entries. Once all entries have been
+	// returned ReadDir returns io.EOF
+	ReadDir(n int) ([]os.FileInfo, error)
+}
+
+// DirStatHandle is implemented by directory handles that can return the
+// attributes of the opened directory. The server uses it to answer
+// SSH_FXP_FSTAT requests and looks up the path of other directory handles
+// using Handler.Stat instead
+type DirStatHandle interface {
+	// Stat returns file information for the directory
+	Stat() (os.FileInfo, error)
+}
+
+// FileAttr holds file attributes sent by a client. Only the fields selected
+// by the corresponding Has* member are valid
+type FileAttr struct {
+	HasSize bool
+	Size    int64
+
+	HasOwner bool
+	UID      uint32
+	GID      uint32
+
+	HasMode bool
+	Mode    os.FileMode
+
+	HasTimes bool
+	ATime    time.Time
+	MTime    time.Time
+}
+
+// newFileAttr converts SFTP file attributes into a FileAttr. Sizes that do
+// not fit into an int64 are rejected with os.ErrInvalid
+func newFileAttr(attr sshfxp.Attr) (FileAttr, error) {
+	var fa FileAttr
+
+	if attr.Flags&sshfxp.FlagAttrSize > 0 {
+		if attr.Size > math.MaxInt64 {
+			return fa, os.ErrInvalid
+		}
+
+		fa.HasSize = true
+		fa.Size = int64(attr.Size)
+	}
+
+	if attr.Flags&sshfxp.FlagAttrUidGid > 0 {
+		fa.HasOwner = true
+		fa.UID = attr.UID
+		fa.GID = attr.GID
+	}
+
+	if attr.Flags&sshfxp.FlagAttrPermissions > 0 {
+		fa.HasMode = true
+		fa.Mode = ToFileMode(attr.Permissions)
+	}
+
+	if attr.Flags&sshfxp.FlagAttrAcModTime > 0 {
+		fa.HasTimes = true
+		fa.ATime = time.Unix(int64(attr.ATime), 0)
+		fa.MTime = time.Unix(int64(attr.MTime), 0)
+	}
+
+	return fa, nil
+}
+
+// fileOwner is implemented by os.FileInfo values that know the numeric owner
+// of a file, like FileInfo
+type fileOwner interface {
+	UID() uint32
+	GID() uint32
+}
+
+// fileAccessTime is implemented by os.FileInfo values that know the last
+// access time of a file, like FileInfo
+type fileAccessTime interface {
+	AccessTime() time.Time
+}
+
+// statAttr returns the SFTP file attributes describing fi
+func statAttr(fi os.FileInfo) sshfxp.Attr {
+	attr := sshfxp.Attr{
+		Flags:       sshfxp.FlagAttrSize | sshfxp.FlagAttrPermissions | sshfxp.FlagAttrAcModTime,
+		Size:        uint64(fi.Size()),
+		Permissions: FromFileMode(fi.Mode()),
+		ATime:       uint32(fi.ModTime().Unix()),
+		MTime:       uint32(fi.ModTime().Unix()),
+	}
+
+	if at, ok := fi.(fileAccessTime); ok && !at.AccessTime().IsZero() {
+		attr.ATime = uint32(at.AccessTime().Unix())
+	}
+
+	if owner, ok := fi.(fileOwner); ok {
+		attr.Flags |= sshfxp.FlagAttrUidGid
+		attr.UID = owner.UID()
+		attr.GID = owner.GID()
+	}
+
+	return attr
+}
+
+// longName formats fi like a line of "ls -l" as expected in the longname
+// field of SSH_FXP_NAME responses
+func longName(fi os.FileInfo) string {
+	var uid, gid uint32
+	if owner, ok := fi.(fileOwner); ok {
+		uid, gid = owner.UID(), owner.GID()
+	}
+
+	mtime := fi.ModTime()
+
+	format := "Jan _2 15:04"
+	if time.Since(mtime) > 180*24*time.Hour || mtime.After(time.Now()) {
+		format = "Jan _2  2006"
+	}
+
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s",
+		lsMode(fi.Mode()), 1, uid, gid, fi.Size(), mtime.Format(format), fi.Name())
+}
+
+// lsMode formats mode like "ls -l" does, e.g. "drwxr-xr-x"
+func lsMode(mode os.FileMode) string {
+	buf := []byte("----------")
+
+	switch {
+	case mode&os.ModeDir != 0:
+		buf[0] = 'd'
+	case mode&os.ModeSymlink != 0:
+		buf[0] = 'l'
+	case mode&os.ModeNamedPipe != 0:
+		buf[0] = 'p'
+	case mode&os.ModeSocket != 0:
+		buf[0] = 's'
+	case mode&os.ModeCharDevice != 0:
+		buf[0] = 'c'
+	case mode&os.ModeDevice != 0:
+		buf[0] = 'b'
+	}
+
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) != 0 {
+			buf[i+1] = rwx[i]
+		}
+	}
+
+	special := func(set bool, idx int, lower byte) {
+		if !set {
+			return
+		}
+
+		if buf[idx] == 'x' {
+			buf[idx] = lower
+		} else {
+			buf[idx] = lower - 'a' + 'A'
+		}
+	}
+
+	special(mode&os.ModeSetuid != 0, 3, 's')
+	special(mode&os.ModeSetgid != 0, 6, 's')
+	special(mode&os.ModeSticky != 0, 9, 't')
+
+	return string(buf)
+}
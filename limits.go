@@ -0,0 +1,31 @@
+package sftp
+
+import "github.com/nethack42/go-sftp/sshfxp"
+
+// Limits describes the limits of a server as announced by the
+// limits@openssh.com extension. Zero values mean the server does not enforce
+// a specific limit. The client respects MaxOpenHandles by waiting to open
+// files and directories while that many handles are open
+type Limits sshfxp.Limits
+
+// DefaultLimits are assumed for servers that do not support the
+// limits@openssh.com extension. They match the minimum packet length servers
+// are required to accept and the read and write length used by OpenSSH
+var DefaultLimits = Limits{
+	MaxPacketLength: 34000,
+	MaxReadLength:   32 * 1024,
+	MaxWriteLength:  32 * 1024,
+}
+
+// packetOverhead is reserved in a packet for the header of a SSH_FXP_WRITE
+// request, including the handle
+const packetOverhead = 1024
+
+// capSize returns size limited to limit. A zero limit means no limit
+func capSize(size int, limit uint64) int {
+	if limit > 0 && uint64(size) > limit {
+		return int(limit)
+	}
+
+	return size
+}
@@ -0,0 +1,252 @@
+package sftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+	"golang.org/x/net/context"
+)
+
+// sizeHandler records the largest reads and writes of its files
+type sizeHandler struct {
+	*MemoryHandler
+
+	m        sync.Mutex
+	maxRead  int
+	maxWrite int
+}
+
+func (h *sizeHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	f, err := h.MemoryHandler.Open(p, flag, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sizeFile{f, h}, nil
+}
+
+type sizeFile struct {
+	FileHandle
+
+	h *sizeHandler
+}
+
+func (f *sizeFile) ReadAt(p []byte, off int64) (int, error) {
+	f.h.m.Lock()
+	if len(p) > f.h.maxRead {
+		f.h.maxRead = len(p)
+	}
+	f.h.m.Unlock()
+
+	return f.FileHandle.ReadAt(p, off)
+}
+
+func (f *sizeFile) WriteAt(p []byte, off int64) (int, error) {
+	f.h.m.Lock()
+	if len(p) > f.h.maxWrite {
+		f.h.maxWrite = len(p)
+	}
+	f.h.m.Unlock()
+
+	return f.FileHandle.WriteAt(p, off)
+}
+
+// announceLimits serves limits@openssh.com with limits
+func announceLimits(limits sshfxp.Limits) ServerOption {
+	return HandleExtension(sshfxp.ExtLimits, "1", func(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error) {
+		return &limits, nil
+	})
+}
+
+func TestTuneAnnouncedLimits(t *testing.T) {
+	limits := sshfxp.Limits{MaxPacketLength: 5000, MaxReadLength: 1000, MaxWriteLength: 2000, MaxOpenHandles: 16}
+
+	h := &sizeHandler{MemoryHandler: NewMemoryHandler()}
+	cli := newServerClient(t, h, announceLimits(limits))
+
+	if cli.Limits() != Limits(limits) {
+		t.Errorf("Limits returned %+v, expected %+v", cli.Limits(), limits)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	f, err := cli.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	r, err := cli.FileReader("/file")
+	if err != nil {
+		t.Fatalf("FileReader: %s", err)
+	}
+
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+
+	if !bytes.Equal(read, data) {
+		t.Errorf("read %d bytes differing from the %d bytes written", len(read), len(data))
+	}
+
+	if h.maxRead > 1000 || h.maxWrite != 2000 {
+		t.Errorf("server received reads of up to %d bytes and writes of up to %d bytes, expected 1000 and 2000", h.maxRead, h.maxWrite)
+	}
+}
+
+func TestTuneSizes(t *testing.T) {
+	small := announceLimits(sshfxp.Limits{MaxPacketLength: 5000, MaxReadLength: 1000})
+
+	tests := []struct {
+		name        string
+		cli         func(t *testing.T) *Client
+		limits      Limits
+		readSize    int
+		writeSize   int
+		concurrency int
+	}{
+		{
+			name:        "server limits",
+			cli:         func(t *testing.T) *Client { return newLoopback(t) },
+			limits:      Limits{MaxPacketLength: uint64(maxPacketLength()), MaxReadLength: uint64(DefaultMaxReadLength), MaxWriteLength: uint64(DefaultMaxWriteLength)},
+			readSize:    DefaultMaxReadLength,
+			writeSize:   DefaultMaxWriteLength,
+			concurrency: DefaultConcurrency * DefaultChunkSize / DefaultMaxReadLength,
+		},
+		{
+			name:        "announced limits",
+			cli:         func(t *testing.T) *Client { return newServerClient(t, NewMemoryHandler(), small) },
+			limits:      Limits{MaxPacketLength: 5000, MaxReadLength: 1000},
+			readSize:    1000,
+			writeSize:   5000 - packetOverhead,
+			concurrency: DefaultConcurrency * DefaultChunkSize / (5000 - packetOverhead),
+		},
+		{
+			name:        "DefaultLimits without limits@openssh.com",
+			cli:         func(t *testing.T) *Client { return newBareClient(t) },
+			limits:      DefaultLimits,
+			readSize:    int(DefaultLimits.MaxReadLength),
+			writeSize:   int(DefaultLimits.MaxWriteLength),
+			concurrency: DefaultConcurrency * DefaultChunkSize / int(DefaultLimits.MaxReadLength),
+		},
+		{
+			name:        "MaxPacket without limits@openssh.com",
+			cli:         func(t *testing.T) *Client { return newBareClient(t, MaxPacket(64*1024)) },
+			limits:      DefaultLimits,
+			readSize:    64 * 1024,
+			writeSize:   64 * 1024,
+			concurrency: DefaultConcurrency * DefaultChunkSize / (64 * 1024),
+		},
+		{
+			name:        "MaxConcurrentRequests",
+			cli:         func(t *testing.T) *Client { return newBareClient(t, MaxConcurrentRequests(3)) },
+			limits:      DefaultLimits,
+			readSize:    int(DefaultLimits.MaxReadLength),
+			writeSize:   int(DefaultLimits.MaxWriteLength),
+			concurrency: 3,
+		},
+	}
+
+	for _, test := range tests {
+		cli := test.cli(t)
+
+		if cli.Limits() != test.limits {
+			t.Errorf("%s: Limits returned %+v, expected %+v", test.name, cli.Limits(), test.limits)
+		}
+
+		if cli.readSize != test.readSize || cli.writeSize != test.writeSize || cli.concurrency != test.concurrency {
+			t.Errorf("%s: client uses %d byte reads, %d byte writes and %d concurrent requests, expected %d, %d and %d",
+				test.name, cli.readSize, cli.writeSize, cli.concurrency, test.readSize, test.writeSize, test.concurrency)
+		}
+	}
+}
+
+func TestMaxOpenHandles(t *testing.T) {
+	cli := newServerClient(t, NewMemoryHandler(), announceLimits(sshfxp.Limits{MaxOpenHandles: 2}))
+
+	first, err := cli.OpenFile("/first", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+
+	if err := cli.MkDir("/dir", nil); err != nil {
+		t.Fatalf("MkDir: %s", err)
+	}
+
+	dir, err := cli.OpenDir("/dir")
+	if err != nil {
+		t.Fatalf("OpenDir: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := cli.OpenFileContext(ctx, "/third", os.O_WRONLY|os.O_CREATE, 0644); err != context.DeadlineExceeded {
+		t.Fatalf("OpenFileContext beyond MaxOpenHandles returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		f, err := cli.OpenFile("/third", os.O_WRONLY|os.O_CREATE, 0644)
+		if err == nil {
+			err = f.Close()
+		}
+		opened <- err
+	}()
+
+	select {
+	case err := <-opened:
+		t.Fatalf("OpenFile beyond MaxOpenHandles returned %v before a handle was closed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("OpenFile after closing a handle: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OpenFile did not proceed after a handle was closed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a failed open does not use up a handle
+	_, err = cli.OpenDirContext(ctx, "/missing")
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusNoSuchFile {
+		t.Fatalf("OpenDir of a missing directory returned %v, expected SSH_FX_NO_SUCH_FILE", err)
+	}
+
+	if err := cli.CloseHandle(dir); err != nil {
+		t.Fatalf("CloseHandle: %s", err)
+	}
+
+	// both handles are available again
+
+	for _, name := range []string{"/a", "/b"} {
+		f, err := cli.OpenFileContext(ctx, name, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("OpenFileContext: %s", err)
+		}
+		defer f.Close()
+	}
+}
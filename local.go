@@ -0,0 +1,392 @@
+//go:build go1.25
+// +build go1.25
+
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// LocalHandler is a Handler serving a directory of the local file system.
+// Clients see the directory as "/" and can never access files outside of it:
+// all paths, including "..", absolute paths and the targets of symbolic
+// links, are resolved within the directory using os.Root. Symbolic links
+// pointing outside of the directory, including all absolute links, cannot
+// be followed. LocalHandler requires Go 1.25 or newer. It supports the
+// statvfs@openssh.com and fstatvfs@openssh.com extensions on Linux only
+type LocalHandler struct {
+	root  *os.Root
+	umask os.FileMode
+	start string
+}
+
+var (
+	_ Handler       = &LocalHandler{}
+	_ PosixRenamer  = &LocalHandler{}
+	_ Linker        = &LocalHandler{}
+	_ SyncHandle    = &localFile{}
+	_ DirStatHandle = &localDir{}
+)
+
+// NewLocalHandler returns a Handler serving the directory dir
+func NewLocalHandler(dir string, opts ...LocalOption) (*LocalHandler, error) {
+	h := &LocalHandler{
+		umask: DefaultUmask,
+		start: "/",
+	}
+
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, fmt.Errorf("invalid option: %s", err)
+		}
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h.root = root
+
+	if fi, err := root.Stat(h.name(h.start)); err != nil || !fi.IsDir() {
+		root.Close()
+		return nil, fmt.Errorf("invalid start directory %q", h.start)
+	}
+
+	return h, nil
+}
+
+// Close releases the root directory of the handler
+func (h *LocalHandler) Close() error {
+	return h.root.Close()
+}
+
+// abs returns the absolute, cleaned form of the client path p
+func (h *LocalHandler) abs(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(h.start, p)
+	}
+
+	return path.Clean("/" + p)
+}
+
+// name returns the name of the client path p relative to the root
+func (h *LocalHandler) name(p string) string {
+	name := strings.TrimPrefix(h.abs(p), "/")
+	if name == "" {
+		return "."
+	}
+
+	return name
+}
+
+func (h *LocalHandler) perm(attr FileAttr, def os.FileMode) os.FileMode {
+	mode := def
+	if attr.HasMode {
+		mode = attr.Mode & localModeMask
+	}
+
+	return mode &^ h.umask
+}
+
+// Open implements Handler
+func (h *LocalHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	name := h.name(p)
+
+	f, err := h.root.OpenFile(name, flag, h.perm(attr, 0666))
+	if err != nil {
+		return nil, err
+	}
+
+	return &localFile{
+		File:   f,
+		h:      h,
+		name:   name,
+		append: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// OpenDir implements Handler
+func (h *LocalHandler) OpenDir(p string) (DirHandle, error) {
+	f, err := h.root.Open(h.name(p))
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		f.Close()
+		return nil, &os.PathError{Op: "opendir", Path: p, Err: errors.New("not a directory")}
+	}
+
+	return &localDir{f}, nil
+}
+
+// Stat implements Handler
+func (h *LocalHandler) Stat(p string) (os.FileInfo, error) {
+	fi, err := h.root.Stat(h.name(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return localFileInfo{fi}, nil
+}
+
+// Lstat implements Handler
+func (h *LocalHandler) Lstat(p string) (os.FileInfo, error) {
+	fi, err := h.root.Lstat(h.name(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return localFileInfo{fi}, nil
+}
+
+// SetStat implements Handler
+func (h *LocalHandler) SetStat(p string, attr FileAttr) error {
+	name := h.name(p)
+
+	if attr.HasSize {
+		f, err := h.root.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+
+		err = f.Truncate(attr.Size)
+		f.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.setStat(name, attr)
+}
+
+// setStat applies all attributes of attr except the size to name
+func (h *LocalHandler) setStat(name string, attr FileAttr) error {
+	if attr.HasMode {
+		if err := h.root.Chmod(name, attr.Mode&localModeMask); err != nil {
+			return err
+		}
+	}
+
+	if attr.HasOwner {
+		if err := h.root.Chown(name, int(attr.UID), int(attr.GID)); err != nil {
+			return err
+		}
+	}
+
+	if attr.HasTimes {
+		if err := h.root.Chtimes(name, attr.ATime, attr.MTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove implements Handler. Directories are not removed
+func (h *LocalHandler) Remove(p string) error {
+	name := h.name(p)
+
+	fi, err := h.root.Lstat(name)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return &os.PathError{Op: "remove", Path: p, Err: errors.New("is a directory")}
+	}
+
+	return h.root.Remove(name)
+}
+
+// Rename implements Handler. Like OpenSSH, regular files are renamed by
+// linking them to newpath first, which fails if newpath exists. Other files
+// and file systems without hard links are checked for an existing newpath
+// before renaming them
+func (h *LocalHandler) Rename(oldpath, newpath string) error {
+	oldname, newname := h.name(oldpath), h.name(newpath)
+
+	fi, err := h.root.Lstat(oldname)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().IsRegular() {
+		err := h.root.Link(oldname, newname)
+		if err == nil {
+			return h.root.Remove(oldname)
+		}
+
+		if os.IsExist(err) {
+			return err
+		}
+	}
+
+	if _, err := h.root.Lstat(newname); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+
+	return h.root.Rename(oldname, newname)
+}
+
+// PosixRename implements PosixRenamer
+func (h *LocalHandler) PosixRename(oldpath, newpath string) error {
+	return h.root.Rename(h.name(oldpath), h.name(newpath))
+}
+
+// Link implements Linker
+func (h *LocalHandler) Link(oldpath, newpath string) error {
+	return h.root.Link(h.name(oldpath), h.name(newpath))
+}
+
+// Mkdir implements Handler
+func (h *LocalHandler) Mkdir(p string, attr FileAttr) error {
+	return h.root.Mkdir(h.name(p), h.perm(attr, 0777))
+}
+
+// Rmdir implements Handler
+func (h *LocalHandler) Rmdir(p string) error {
+	name := h.name(p)
+	if name == "." {
+		return &os.PathError{Op: "rmdir", Path: p, Err: os.ErrPermission}
+	}
+
+	fi, err := h.root.Lstat(name)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return &os.PathError{Op: "rmdir", Path: p, Err: errors.New("not a directory")}
+	}
+
+	return h.root.Remove(name)
+}
+
+// RealPath implements Handler. Paths are resolved lexically against the
+// start directory
+func (h *LocalHandler) RealPath(p string) (string, error) {
+	return h.abs(p), nil
+}
+
+// ReadLink implements Handler
+func (h *LocalHandler) ReadLink(p string) (string, error) {
+	return h.root.Readlink(h.name(p))
+}
+
+// Symlink implements Handler. target is stored as is. Links that resolve
+// outside of the root directory can be created but not followed
+func (h *LocalHandler) Symlink(target, linkpath string) error {
+	return h.root.Symlink(target, h.name(linkpath))
+}
+
+// localFile is a file opened by LocalHandler
+type localFile struct {
+	*os.File
+
+	h      *LocalHandler
+	name   string
+	append bool
+}
+
+// WriteAt implements io.WriterAt. Files opened with O_APPEND ignore off
+func (f *localFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.append {
+		return f.File.Write(p)
+	}
+
+	return f.File.WriteAt(p, off)
+}
+
+// Stat implements FileHandle
+func (f *localFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return localFileInfo{fi}, nil
+}
+
+// SetStat implements FileHandle
+func (f *localFile) SetStat(attr FileAttr) error {
+	if attr.HasSize {
+		if err := f.File.Truncate(attr.Size); err != nil {
+			return err
+		}
+	}
+
+	if attr.HasMode {
+		if err := f.File.Chmod(attr.Mode & localModeMask); err != nil {
+			return err
+		}
+	}
+
+	if attr.HasOwner {
+		if err := f.File.Chown(int(attr.UID), int(attr.GID)); err != nil {
+			return err
+		}
+	}
+
+	if attr.HasTimes {
+		err := futimes(f.File, attr.ATime, attr.MTime)
+		if !errors.Is(err, ErrUnsupported) {
+			return err
+		}
+
+		// the platform only sets times by name, which may refer to another
+		// file by now
+		return f.h.root.Chtimes(f.name, attr.ATime, attr.MTime)
+	}
+
+	return nil
+}
+
+// sameFile implements fileIdentity
+func (fi localFileInfo) sameFile(other os.FileInfo) bool {
+	o, ok := other.(localFileInfo)
+	return ok && os.SameFile(fi.FileInfo, o.FileInfo)
+}
+
+// localDir is a directory opened by LocalHandler
+type localDir struct {
+	f *os.File
+}
+
+// Stat implements DirStatHandle
+func (d *localDir) Stat() (os.FileInfo, error) {
+	fi, err := d.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return localFileInfo{fi}, nil
+}
+
+// ReadDir implements DirHandle
+func (d *localDir) ReadDir(n int) ([]os.FileInfo, error) {
+	list, err := d.f.Readdir(n)
+
+	for i := range list {
+		list[i] = localFileInfo{list[i]}
+	}
+
+	return list, err
+}
+
+// Close implements DirHandle
+func (d *localDir) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package sftp
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// futimes sets the access and modification times of the open file f
+func futimes(f *os.File, atime, mtime time.Time) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	tv := []syscall.Timeval{
+		syscall.NsecToTimeval(atime.UnixNano()),
+		syscall.NsecToTimeval(mtime.UnixNano()),
+	}
+
+	var serr error
+	if err := conn.Control(func(fd uintptr) {
+		serr = syscall.Futimes(int(fd), tv)
+	}); err != nil {
+		return err
+	}
+
+	if serr != nil {
+		return &os.PathError{Op: "futimes", Path: f.Name(), Err: serr}
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package sftp
+
+import (
+	"os"
+	"time"
+)
+
+// futimes returns ErrUnsupported as the times of open files can not be set
+// on this platform
+func futimes(f *os.File, atime, mtime time.Time) error {
+	return ErrUnsupported
+}
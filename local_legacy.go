@@ -0,0 +1,32 @@
+//go:build !go1.25
+// +build !go1.25
+
+package sftp
+
+import (
+	"errors"
+	"os"
+)
+
+// errLocalUnsupported is returned by NewLocalHandler if the package has been
+// built without os.Root
+var errLocalUnsupported = errors.New("local handler requires Go 1.25")
+
+// LocalHandler serves a directory of the local file system. It depends on
+// os.Root and is not available before Go 1.25
+type LocalHandler struct {
+	Handler
+
+	umask os.FileMode
+	start string
+}
+
+// NewLocalHandler always fails before Go 1.25
+func NewLocalHandler(dir string, opts ...LocalOption) (*LocalHandler, error) {
+	return nil, errLocalUnsupported
+}
+
+// Close implements io.Closer
+func (h *LocalHandler) Close() error {
+	return nil
+}
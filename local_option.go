@@ -0,0 +1,39 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// DefaultUmask is the umask applied to files and directories created by a
+// LocalHandler
+var DefaultUmask os.FileMode = 0022
+
+// localModeMask selects the mode bits clients may set
+const localModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// LocalOption configures a LocalHandler created by NewLocalHandler
+type LocalOption func(*LocalHandler) error
+
+// WithUmask sets the umask applied to the permissions of created files and
+// directories. It defaults to DefaultUmask
+func WithUmask(mask os.FileMode) LocalOption {
+	return func(h *LocalHandler) error {
+		if mask&^os.ModePerm != 0 {
+			return fmt.Errorf("invalid umask %o", mask)
+		}
+
+		h.umask = mask
+		return nil
+	}
+}
+
+// WithStartDirectory sets the directory, relative to the root, that relative
+// paths sent by clients are resolved against. It defaults to the root itself
+func WithStartDirectory(dir string) LocalOption {
+	return func(h *LocalHandler) error {
+		h.start = path.Clean("/" + dir)
+		return nil
+	}
+}
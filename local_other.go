@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package sftp
+
+import "os"
+
+// localFileInfo wraps file information of the local file system. The owner of
+// files is not available on this platform
+type localFileInfo struct {
+	os.FileInfo
+}
@@ -0,0 +1,79 @@
+//go:build linux && go1.25
+// +build linux,go1.25
+
+package sftp
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+var (
+	_ StatVFSHandler = &LocalHandler{}
+	_ StatVFSHandle  = &localFile{}
+	_ StatVFSHandle  = &localDir{}
+)
+
+// StatVFS implements StatVFSHandler. path is opened within the root
+// directory so symbolic links can not escape it
+func (h *LocalHandler) StatVFS(path string) (*StatVFS, error) {
+	f, err := h.root.Open(h.name(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return statVFS(f)
+}
+
+// StatVFS implements StatVFSHandle
+func (f *localFile) StatVFS() (*StatVFS, error) {
+	return statVFS(f.File)
+}
+
+// StatVFS implements StatVFSHandle
+func (d *localDir) StatVFS() (*StatVFS, error) {
+	return statVFS(d.f)
+}
+
+// statVFS returns statistics of the file system containing f
+func statVFS(f *os.File) (*StatVFS, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Fstatfs(int(f.Fd()), &st); err != nil {
+		return nil, &os.PathError{Op: "statvfs", Path: f.Name(), Err: err}
+	}
+
+	// ST_RDONLY and ST_NOSUID share their values with the SFTP flags
+	var flag uint64
+	if st.Flags&sshfxp.StatVFSReadOnly != 0 {
+		flag |= sshfxp.StatVFSReadOnly
+	}
+
+	if st.Flags&sshfxp.StatVFSNoSUID != 0 {
+		flag |= sshfxp.StatVFSNoSUID
+	}
+
+	frsize := uint64(st.Frsize)
+	if frsize == 0 {
+		frsize = uint64(st.Bsize)
+	}
+
+	// statfs(2) does not count inodes reserved for privileged users, so all
+	// free inodes are reported as available like statvfs(3) of glibc does
+	return &StatVFS{
+		BlockSize:    uint64(st.Bsize),
+		FragmentSize: frsize,
+		Blocks:       st.Blocks,
+		BlocksFree:   st.Bfree,
+		BlocksAvail:  st.Bavail,
+		Files:        st.Files,
+		FilesFree:    st.Ffree,
+		FilesAvail:   st.Ffree,
+		FSID:         uint64(uint32(st.Fsid.X__val[0]))<<32 | uint64(uint32(st.Fsid.X__val[1])),
+		Flag:         flag,
+		NameMax:      uint64(st.Namelen),
+	}, nil
+}
@@ -0,0 +1,42 @@
+//go:build linux && go1.25
+
+package sftp
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestLocalHandlerStatVFS(t *testing.T) {
+	h, outer := newLocalJail(t)
+	cli := newServerClient(t, h)
+
+	var expected syscall.Statfs_t
+	if err := syscall.Statfs(outer, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := cli.StatVFS("/home")
+	if err != nil {
+		t.Fatalf("StatVFS: %s", err)
+	}
+
+	if st.Blocks != expected.Blocks || st.Files != expected.Files || st.NameMax != uint64(expected.Namelen) {
+		t.Errorf("StatVFS returned %+v, expected %+v", *st, expected)
+	}
+
+	if st.FilesAvail != st.FilesFree {
+		t.Errorf("StatVFS reports %d available and %d free inodes", st.FilesAvail, st.FilesFree)
+	}
+
+	f, err := cli.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	if fst, err := f.StatVFS(); err != nil || fst.FSID != st.FSID {
+		t.Errorf("File.StatVFS returned %+v, %v", fst, err)
+	}
+}
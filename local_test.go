@@ -0,0 +1,252 @@
+//go:build go1.25 && !windows && !plan9
+
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newLocalJail creates a directory containing the file secret and the
+// directory jail. It returns a LocalHandler serving jail and the path of the
+// outer directory
+func newLocalJail(t *testing.T) (*LocalHandler, string) {
+	t.Helper()
+
+	outer := t.TempDir()
+
+	if err := ioutil.WriteFile(filepath.Join(outer, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jail := filepath.Join(outer, "jail")
+	if err := os.MkdirAll(filepath.Join(jail, "home"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewLocalHandler(jail, WithStartDirectory("/home"))
+	if err != nil {
+		t.Fatalf("NewLocalHandler: %s", err)
+	}
+
+	t.Cleanup(func() { h.Close() })
+
+	return h, outer
+}
+
+// assertConfined fails if p can be used to access the secret file
+func assertConfined(t *testing.T, h *LocalHandler, p string) {
+	t.Helper()
+
+	if _, err := h.Stat(p); err == nil {
+		t.Errorf("Stat(%q) succeeded", p)
+	}
+
+	if f, err := h.Open(p, os.O_RDONLY, FileAttr{}); err == nil {
+		f.Close()
+		t.Errorf("Open(%q) succeeded", p)
+	}
+
+	if f, err := h.Open(p, os.O_WRONLY|os.O_TRUNC, FileAttr{}); err == nil {
+		f.Close()
+		t.Errorf("Open(%q) for writing succeeded", p)
+	}
+}
+
+func assertSecretIntact(t *testing.T, outer string) {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join(outer, "secret"))
+	if err != nil || string(data) != "secret" {
+		t.Errorf("secret has been modified: %q, %v", data, err)
+	}
+}
+
+func TestLocalHandlerDotDot(t *testing.T) {
+	h, outer := newLocalJail(t)
+
+	for _, p := range []string{"../../secret", "/../secret", "/home/../../secret", "../../../jail/../secret"} {
+		assertConfined(t, h, p)
+	}
+
+	if p, _ := h.RealPath("../../.."); p != "/" {
+		t.Errorf("RealPath returned %q, expected /", p)
+	}
+
+	if err := h.Mkdir("../../outside", FileAttr{}); err != nil {
+		t.Fatalf("Mkdir: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outer, "outside")); err == nil {
+		t.Error("Mkdir created a directory outside of the root")
+	}
+
+	assertSecretIntact(t, outer)
+}
+
+func TestLocalHandlerSymlinks(t *testing.T) {
+	h, outer := newLocalJail(t)
+	jail := filepath.Join(outer, "jail")
+
+	// relative link created by the client
+	if err := h.Symlink("../../secret", "/home/relative"); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	// absolute links placed in the directory by someone else
+	if err := os.Symlink(filepath.Join(outer, "secret"), filepath.Join(jail, "absfile")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outer, filepath.Join(jail, "absdir")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/home/relative", "/absfile", "/absdir/secret"} {
+		assertConfined(t, h, p)
+	}
+
+	if d, err := h.OpenDir("/absdir"); err == nil {
+		d.Close()
+		t.Error("OpenDir followed an absolute symlink")
+	}
+
+	if err := h.Mkdir("/absdir/new", FileAttr{}); err == nil {
+		t.Error("Mkdir followed an absolute symlink")
+	}
+
+	if err := h.SetStat("/absfile", FileAttr{HasSize: true}); err == nil {
+		t.Error("SetStat followed an absolute symlink")
+	}
+
+	if err := h.Rename("/absdir/secret", "/stolen"); err == nil {
+		t.Error("Rename followed an absolute symlink")
+	}
+
+	if err := h.Link("/absdir/secret", "/stolen"); err == nil {
+		t.Error("Link followed an absolute symlink")
+	}
+
+	// the links themselves are accessible
+	if target, err := h.ReadLink("/home/relative"); err != nil || target != "../../secret" {
+		t.Errorf("ReadLink returned %q, %v", target, err)
+	}
+
+	if _, err := h.Lstat("/absfile"); err != nil {
+		t.Errorf("Lstat: %s", err)
+	}
+
+	assertSecretIntact(t, outer)
+}
+
+func TestLocalHandlerLinkToEscapingSymlink(t *testing.T) {
+	h, outer := newLocalJail(t)
+
+	if err := h.Symlink("../../secret", "/home/relative"); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	// a hard link to the symbolic link is allowed, but is a symbolic link
+	// escaping the root itself
+	if err := h.Link("/home/relative", "/hard"); err != nil {
+		t.Fatalf("Link: %s", err)
+	}
+
+	fi, err := h.Lstat("/hard")
+	if err != nil {
+		t.Fatalf("Lstat: %s", err)
+	}
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("hard link has mode %s, expected a symbolic link", fi.Mode())
+	}
+
+	assertConfined(t, h, "/hard")
+	assertSecretIntact(t, outer)
+}
+
+func TestLocalHandlerDirHandleStat(t *testing.T) {
+	h, _ := newLocalJail(t)
+	cli := newServerClient(t, h)
+
+	handle, err := cli.OpenDir("/home")
+	if err != nil {
+		t.Fatalf("OpenDir: %s", err)
+	}
+	defer cli.CloseHandle(handle)
+
+	if err := cli.Fchmod(handle, 0700); err != nil {
+		t.Fatalf("Fchmod of a directory handle: %s", err)
+	}
+
+	fi, err := cli.Fstat(handle)
+	if err != nil {
+		t.Fatalf("Fstat of a directory handle: %s", err)
+	}
+
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Errorf("Fstat returned mode %s, expected a directory with permissions 0700", fi.Mode())
+	}
+}
+
+func TestLocalHandlerCopyToLink(t *testing.T) {
+	h, _ := newLocalJail(t)
+	cli := newServerClient(t, h)
+
+	putFile(t, cli, "/src", "source data")
+
+	if err := cli.Symlink("src", "/symlink"); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	if err := cli.Link("/src", "/hardlink"); err != nil {
+		t.Fatalf("Link: %s", err)
+	}
+
+	testCopyToLink(t, cli, "/symlink")
+	testCopyToLink(t, cli, "/hardlink")
+}
+
+func TestLocalHandlerFchtimes(t *testing.T) {
+	h, _ := newLocalJail(t)
+	cli := newServerClient(t, h)
+
+	f, err := cli.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	// the name of the open file refers to another file now
+	if err := cli.Rename("/file", "/moved"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+
+	putFile(t, cli, "/file", "new")
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := cli.Fchtimes(f.Handle(), mtime, mtime); err != nil {
+		t.Fatalf("Fchtimes: %s", err)
+	}
+
+	fi, err := cli.Stat("/moved")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("open file has modification time %v, expected %v", fi.ModTime(), mtime)
+	}
+
+	fi, err = cli.Stat("/file")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+
+	if fi.ModTime().Equal(mtime) {
+		t.Error("Fchtimes changed the file now using the name of the open file")
+	}
+}
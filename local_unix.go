@@ -0,0 +1,33 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package sftp
+
+import (
+	"os"
+	"syscall"
+)
+
+// localFileInfo adds the numeric owner to file information of the local file
+// system
+type localFileInfo struct {
+	os.FileInfo
+}
+
+// UID returns the numeric user ID of the owner of the file
+func (fi localFileInfo) UID() uint32 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid
+	}
+
+	return 0
+}
+
+// GID returns the numeric group ID of the file
+func (fi localFileInfo) GID() uint32 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Gid
+	}
+
+	return 0
+}
@@ -0,0 +1,29 @@
+package sftp
+
+import "io"
+
+// NewLoopbackClient starts a Server serving handler and returns a Client
+// connected to it using in-process pipes. The server stops once the client
+// connection is closed using Close. Together with a MemoryHandler this
+// allows to test code using a Client without a real SFTP server:
+//
+//	cli, err := sftp.NewLoopbackClient(sftp.NewMemoryHandler())
+func NewLoopbackClient(handler Handler, opts ...ClientOption) (*Client, error) {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	srv, err := NewServer(serverReader, serverWriter, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := srv.Serve(); err != nil && err != io.ErrClosedPipe {
+			srv.log.Debugf("loopback server exited: %s", err)
+		}
+
+		serverWriter.Close()
+	}()
+
+	return NewClientPipe(clientReader, clientWriter, opts...)
+}
@@ -0,0 +1,171 @@
+package sftp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+func newLoopback(t *testing.T) *Client {
+	t.Helper()
+
+	cli, err := NewLoopbackClient(NewMemoryHandler())
+	if err != nil {
+		t.Fatalf("NewLoopbackClient: %s", err)
+	}
+
+	t.Cleanup(func() { cli.Close() })
+
+	return cli
+}
+
+func statusCodeOf(err error) (uint32, bool) {
+	var statusErr *sshfxp.FxpStatusError
+	if !errors.As(err, &statusErr) {
+		return 0, false
+	}
+
+	return statusErr.Code, true
+}
+
+func TestLoopbackFiles(t *testing.T) {
+	cli := newLoopback(t)
+
+	if err := cli.MkDir("/dir", nil); err != nil {
+		t.Fatalf("MkDir: %s", err)
+	}
+
+	f, err := cli.OpenFile("/dir/file", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+
+	if _, err := f.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 6); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	}
+
+	if string(buf) != "world" {
+		t.Errorf("ReadAt returned %q, expected %q", buf, "world")
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	info, err := cli.Stat("/dir/file")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+
+	if info.Size() != 11 || info.IsDir() {
+		t.Errorf("Stat returned size %d, dir %t", info.Size(), info.IsDir())
+	}
+
+	list, err := cli.List("/dir")
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+
+	if len(list) != 1 || list[0].Name() != "file" {
+		t.Fatalf("List returned %d entries, expected only file", len(list))
+	}
+
+	if err := cli.Rename("/dir/file", "/dir/moved"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+
+	r, err := cli.FileReader("/dir/moved")
+	if err != nil {
+		t.Fatalf("FileReader: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	if string(data) != "hello world" {
+		t.Errorf("read %q after rename", data)
+	}
+
+	if err := cli.Remove("/dir/moved"); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+
+	_, err = cli.Stat("/dir/moved")
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusNoSuchFile {
+		t.Errorf("Stat of removed file returned %v, expected SSH_FX_NO_SUCH_FILE", err)
+	}
+
+	if err := cli.RmDir("/dir"); err != nil {
+		t.Fatalf("RmDir: %s", err)
+	}
+}
+
+func TestLoopbackInvalidOffset(t *testing.T) {
+	cli := newLoopback(t)
+
+	f, err := cli.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := cli.Read(f.Handle(), 1<<63, 10); err == nil {
+		t.Error("Read at offset 1<<63 succeeded")
+	} else if code, _ := statusCodeOf(err); code != sshfxp.StatusFailure {
+		t.Errorf("Read at offset 1<<63 returned %v, expected SSH_FX_FAILURE", err)
+	}
+
+	if err := cli.Write(f.Handle(), 1<<63, []byte("x")); err == nil {
+		t.Error("Write at offset 1<<63 succeeded")
+	}
+
+	if err := cli.Ftruncate(f.Handle(), -1); err == nil {
+		t.Error("Ftruncate to -1 succeeded")
+	}
+
+	// the server must still serve requests
+	if _, err := f.Write([]byte("ok")); err != nil {
+		t.Fatalf("Write after invalid requests: %s", err)
+	}
+
+	info, err := cli.Stat("/file")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+
+	if info.Size() != 2 {
+		t.Errorf("file has size %d, expected 2", info.Size())
+	}
+}
+
+func TestLoopbackMaxFileSize(t *testing.T) {
+	cli := newLoopback(t)
+
+	f, err := cli.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	if err := cli.Write(f.Handle(), uint64(MaxMemoryFileSize), []byte("x")); err == nil {
+		t.Error("write beyond MaxMemoryFileSize succeeded")
+	}
+
+	if err := cli.Truncate("/file", MaxMemoryFileSize+1); err == nil {
+		t.Error("truncate beyond MaxMemoryFileSize succeeded")
+	}
+}
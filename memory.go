@@ -0,0 +1,736 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSymlinkHops is the number of symbolic links followed while resolving a
+// single path
+const maxSymlinkHops = 40
+
+// MaxMemoryFileSize is the maximum size of a single file of a MemoryHandler.
+// Writes and truncates beyond it fail
+var MaxMemoryFileSize int64 = 1 << 30
+
+var (
+	errTooLarge = errors.New("file too large")
+	errNotDir   = errors.New("not a directory")
+	errIsDir    = errors.New("is a directory")
+	errNotEmpty = errors.New("directory not empty")
+	errTooMany  = errors.New("too many levels of symbolic links")
+)
+
+// memNode is a file, directory or symbolic link of a MemoryHandler
+type memNode struct {
+	name    string
+	mode    os.FileMode
+	modtime time.Time
+	atime   time.Time
+	uid     uint32
+	gid     uint32
+
+	data     []byte              // regular files
+	target   string              // symbolic links
+	children map[string]*memNode // directories
+}
+
+func (n *memNode) fileInfo() FileInfo {
+	fi := FileInfo{
+		name:    n.name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modtime: n.modtime,
+		atime:   n.atime,
+		uid:     n.uid,
+		gid:     n.gid,
+	}
+
+	if n.mode&os.ModeSymlink != 0 {
+		fi.size = int64(len(n.target))
+	}
+
+	fi.packet.Filename = n.name
+	fi.packet.Attr = statAttr(fi)
+
+	return fi
+}
+
+// MemoryHandler is a Handler keeping a complete file system in memory. It
+// supports regular files, directories and symbolic links. Permissions are
+// checked against the owner bits only. MemoryHandler is mainly useful for
+// testing code using a Client, see NewLoopbackClient
+type MemoryHandler struct {
+	m    sync.Mutex
+	root *memNode
+}
+
+var (
+	_ Handler      = &MemoryHandler{}
+	_ PosixRenamer = &MemoryHandler{}
+	_ SyncHandle   = &memFile{}
+)
+
+// NewMemoryHandler returns a MemoryHandler holding an empty root directory
+func NewMemoryHandler() *MemoryHandler {
+	now := time.Now()
+
+	return &MemoryHandler{
+		root: &memNode{
+			name:     "/",
+			mode:     os.ModeDir | 0755,
+			modtime:  now,
+			atime:    now,
+			children: make(map[string]*memNode),
+		},
+	}
+}
+
+// lookup resolves p and returns the node it refers to together with its
+// parent directory and its name within the parent. If the last element of p
+// does not exist, node is nil but parent and name are still returned. If
+// follow is set, a symbolic link as last element is followed as well
+func (h *MemoryHandler) lookup(op, p string, follow bool) (node, parent *memNode, name string, err error) {
+	perr := func(err error) error {
+		return &os.PathError{Op: op, Path: p, Err: err}
+	}
+
+	var (
+		hops  int
+		dir   = h.root
+		dirp  = "/"
+		elems = splitPath(p)
+	)
+
+	for len(elems) > 0 {
+		name = elems[0]
+		elems = elems[1:]
+
+		if dir.mode&os.ModeDir == 0 {
+			return nil, nil, "", perr(errNotDir)
+		}
+
+		if dir.mode&0100 == 0 {
+			return nil, nil, "", perr(os.ErrPermission)
+		}
+
+		child, ok := dir.children[name]
+		if !ok {
+			if len(elems) > 0 {
+				return nil, nil, "", perr(os.ErrNotExist)
+			}
+
+			return nil, dir, name, nil
+		}
+
+		if child.mode&os.ModeSymlink != 0 && (len(elems) > 0 || follow) {
+			hops++
+			if hops > maxSymlinkHops {
+				return nil, nil, "", perr(errTooMany)
+			}
+
+			target := child.target
+			if !path.IsAbs(target) {
+				target = path.Join(dirp, target)
+			}
+
+			// restart from the root with the link resolved
+			elems = append(splitPath(target), elems...)
+			dir, dirp = h.root, "/"
+			continue
+		}
+
+		if len(elems) == 0 {
+			return child, dir, name, nil
+		}
+
+		dir, dirp = child, path.Join(dirp, name)
+	}
+
+	// p refers to the root directory
+	return dir, dir, ".", nil
+}
+
+// resolve is like lookup but fails if p does not exist
+func (h *MemoryHandler) resolve(op, p string, follow bool) (*memNode, error) {
+	node, _, _, err := h.lookup(op, p, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	if node == nil {
+		return nil, &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+
+	return node, nil
+}
+
+// create adds a new node to the directory containing p
+func (h *MemoryHandler) create(op, p string, mode os.FileMode) (*memNode, error) {
+	node, parent, name, err := h.lookup(op, p, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if node != nil {
+		return nil, &os.PathError{Op: op, Path: p, Err: os.ErrExist}
+	}
+
+	return add(op, p, parent, name, mode)
+}
+
+// add creates a new node called name within parent
+func add(op, p string, parent *memNode, name string, mode os.FileMode) (*memNode, error) {
+	if parent.mode&0200 == 0 {
+		return nil, &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+	}
+
+	now := time.Now()
+
+	node := &memNode{
+		name:    name,
+		mode:    mode,
+		modtime: now,
+		atime:   now,
+	}
+
+	if mode&os.ModeDir != 0 {
+		node.children = make(map[string]*memNode)
+	}
+
+	parent.children[name] = node
+	parent.modtime = now
+
+	return node, nil
+}
+
+// Open implements Handler
+func (h *MemoryHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, parent, name, err := h.lookup("open", p, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if node != nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	}
+
+	if node == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		}
+
+		mode := os.FileMode(0644)
+		if attr.HasMode {
+			mode = attr.Mode & localModeMask
+		}
+
+		// the new file is opened even if mode does not permit access,
+		// matching open(2)
+		node, err = add("open", p, parent, name, mode)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if node.mode&os.ModeDir != 0 {
+			return nil, &os.PathError{Op: "open", Path: p, Err: errIsDir}
+		}
+
+		if !canAccess(node, flag) {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrPermission}
+		}
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.data = nil
+		node.modtime = time.Now()
+	}
+
+	return &memFile{
+		h:      h,
+		node:   node,
+		flag:   flag,
+		append: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// canAccess checks the owner bits of node for the access mode of flag
+func canAccess(node *memNode, flag int) bool {
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		return node.mode&0400 != 0
+	case os.O_WRONLY:
+		return node.mode&0200 != 0
+	default:
+		return node.mode&0600 == 0600
+	}
+}
+
+// OpenDir implements Handler
+func (h *MemoryHandler) OpenDir(p string) (DirHandle, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, err := h.resolve("opendir", p, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.mode&os.ModeDir == 0 {
+		return nil, &os.PathError{Op: "opendir", Path: p, Err: errNotDir}
+	}
+
+	if node.mode&0400 == 0 {
+		return nil, &os.PathError{Op: "opendir", Path: p, Err: os.ErrPermission}
+	}
+
+	var list []os.FileInfo
+	for _, child := range node.children {
+		list = append(list, child.fileInfo())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+
+	node.atime = time.Now()
+
+	return &memDir{list: list}, nil
+}
+
+// Stat implements Handler
+func (h *MemoryHandler) Stat(p string) (os.FileInfo, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, err := h.resolve("stat", p, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.fileInfo(), nil
+}
+
+// Lstat implements Handler
+func (h *MemoryHandler) Lstat(p string) (os.FileInfo, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, err := h.resolve("lstat", p, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.fileInfo(), nil
+}
+
+// SetStat implements Handler
+func (h *MemoryHandler) SetStat(p string, attr FileAttr) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, err := h.resolve("setstat", p, true)
+	if err != nil {
+		return err
+	}
+
+	return setMemAttr("setstat", p, node, attr)
+}
+
+// setMemAttr applies attr to node
+func setMemAttr(op, p string, node *memNode, attr FileAttr) error {
+	if attr.HasSize {
+		if node.mode&os.ModeDir != 0 {
+			return &os.PathError{Op: op, Path: p, Err: errIsDir}
+		}
+
+		if attr.Size < 0 {
+			return &os.PathError{Op: op, Path: p, Err: os.ErrInvalid}
+		}
+
+		if attr.Size > MaxMemoryFileSize {
+			return &os.PathError{Op: op, Path: p, Err: errTooLarge}
+		}
+
+		data := make([]byte, attr.Size)
+		copy(data, node.data)
+
+		node.data = data
+		node.modtime = time.Now()
+	}
+
+	if attr.HasMode {
+		node.mode = node.mode&^localModeMask | attr.Mode&localModeMask
+	}
+
+	if attr.HasOwner {
+		node.uid = attr.UID
+		node.gid = attr.GID
+	}
+
+	if attr.HasTimes {
+		node.atime = attr.ATime
+		node.modtime = attr.MTime
+	}
+
+	return nil
+}
+
+// Remove implements Handler. Directories are not removed
+func (h *MemoryHandler) Remove(p string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, parent, name, err := h.lookup("remove", p, false)
+	if err != nil {
+		return err
+	}
+
+	if node == nil {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+
+	if node.mode&os.ModeDir != 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: errIsDir}
+	}
+
+	return unlink("remove", p, parent, name)
+}
+
+// unlink removes name from parent after checking permissions
+func unlink(op, p string, parent *memNode, name string) error {
+	if parent.mode&0200 == 0 {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrPermission}
+	}
+
+	delete(parent.children, name)
+	parent.modtime = time.Now()
+
+	return nil
+}
+
+// Rename implements Handler
+func (h *MemoryHandler) Rename(oldpath, newpath string) error {
+	return h.rename(oldpath, newpath, false)
+}
+
+// PosixRename implements PosixRenamer. An existing file at newpath is
+// replaced like rename(2) does
+func (h *MemoryHandler) PosixRename(oldpath, newpath string) error {
+	return h.rename(oldpath, newpath, true)
+}
+
+// rename moves oldpath to newpath. If replace is false, rename fails if
+// newpath exists
+func (h *MemoryHandler) rename(oldpath, newpath string, replace bool) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, oldParent, oldName, err := h.lookup("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+
+	if node == nil || node == h.root {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+
+	target, newParent, newName, err := h.lookup("rename", newpath, false)
+	if err != nil {
+		return err
+	}
+
+	if target == node {
+		return nil
+	}
+
+	if target != nil {
+		switch {
+		case !replace:
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+		case target.mode&os.ModeDir != 0 && node.mode&os.ModeDir == 0:
+			return &os.PathError{Op: "rename", Path: newpath, Err: errIsDir}
+		case target.mode&os.ModeDir == 0 && node.mode&os.ModeDir != 0:
+			return &os.PathError{Op: "rename", Path: newpath, Err: errNotDir}
+		case len(target.children) > 0:
+			return &os.PathError{Op: "rename", Path: newpath, Err: errNotEmpty}
+		}
+	}
+
+	// a directory must not be moved into itself
+	for dir := newParent; node.mode&os.ModeDir != 0 && dir != nil; dir = h.parentOf(dir) {
+		if dir == node {
+			return &os.PathError{Op: "rename", Path: newpath, Err: errors.New("invalid argument")}
+		}
+	}
+
+	if oldParent.mode&0200 == 0 || newParent.mode&0200 == 0 {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrPermission}
+	}
+
+	delete(oldParent.children, oldName)
+	node.name = newName
+	newParent.children[newName] = node
+
+	now := time.Now()
+	oldParent.modtime = now
+	newParent.modtime = now
+
+	return nil
+}
+
+// parentOf returns the directory containing dir or nil for the root
+// directory
+func (h *MemoryHandler) parentOf(dir *memNode) *memNode {
+	var walk func(n *memNode) *memNode
+
+	walk = func(n *memNode) *memNode {
+		for _, child := range n.children {
+			if child == dir {
+				return n
+			}
+
+			if child.mode&os.ModeDir != 0 {
+				if p := walk(child); p != nil {
+					return p
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return walk(h.root)
+}
+
+// Mkdir implements Handler
+func (h *MemoryHandler) Mkdir(p string, attr FileAttr) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	mode := os.FileMode(0755)
+	if attr.HasMode {
+		mode = attr.Mode & localModeMask
+	}
+
+	_, err := h.create("mkdir", p, os.ModeDir|mode)
+
+	return err
+}
+
+// Rmdir implements Handler
+func (h *MemoryHandler) Rmdir(p string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, parent, name, err := h.lookup("rmdir", p, false)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case node == nil:
+		return &os.PathError{Op: "rmdir", Path: p, Err: os.ErrNotExist}
+	case node == h.root:
+		return &os.PathError{Op: "rmdir", Path: p, Err: os.ErrPermission}
+	case node.mode&os.ModeDir == 0:
+		return &os.PathError{Op: "rmdir", Path: p, Err: errNotDir}
+	case len(node.children) > 0:
+		return &os.PathError{Op: "rmdir", Path: p, Err: errNotEmpty}
+	}
+
+	return unlink("rmdir", p, parent, name)
+}
+
+// RealPath implements Handler. Relative paths are resolved against the root
+// directory
+func (h *MemoryHandler) RealPath(p string) (string, error) {
+	return path.Clean("/" + p), nil
+}
+
+// ReadLink implements Handler
+func (h *MemoryHandler) ReadLink(p string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, err := h.resolve("readlink", p, false)
+	if err != nil {
+		return "", err
+	}
+
+	if node.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: errors.New("not a symbolic link")}
+	}
+
+	return node.target, nil
+}
+
+// Symlink implements Handler
+func (h *MemoryHandler) Symlink(target, linkpath string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	node, err := h.create("symlink", linkpath, os.ModeSymlink|0777)
+	if err != nil {
+		return err
+	}
+
+	node.target = target
+
+	return nil
+}
+
+// memFile is a file opened by MemoryHandler
+type memFile struct {
+	h      *MemoryHandler
+	node   *memNode
+	flag   int
+	append bool
+}
+
+// ReadAt implements io.ReaderAt
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, os.ErrPermission
+	}
+
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	f.h.m.Lock()
+	defer f.h.m.Unlock()
+
+	f.node.atime = time.Now()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt. Files opened with O_APPEND ignore off
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, os.ErrPermission
+	}
+
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	f.h.m.Lock()
+	defer f.h.m.Unlock()
+
+	if f.append {
+		off = int64(len(f.node.data))
+	}
+
+	if off > MaxMemoryFileSize-int64(len(p)) {
+		return 0, errTooLarge
+	}
+
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+
+	copy(f.node.data[off:], p)
+	f.node.modtime = time.Now()
+
+	return len(p), nil
+}
+
+// Stat implements FileHandle
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.h.m.Lock()
+	defer f.h.m.Unlock()
+
+	return memFileInfo{f.node.fileInfo(), f.node}, nil
+}
+
+// memFileInfo is the file information of an open memFile. It keeps the node
+// to tell whether two files are the same
+type memFileInfo struct {
+	FileInfo
+
+	node *memNode
+}
+
+// sameFile implements fileIdentity
+func (fi memFileInfo) sameFile(other os.FileInfo) bool {
+	o, ok := other.(memFileInfo)
+	return ok && o.node == fi.node
+}
+
+// SetStat implements FileHandle
+func (f *memFile) SetStat(attr FileAttr) error {
+	f.h.m.Lock()
+	defer f.h.m.Unlock()
+
+	return setMemAttr("fsetstat", f.node.name, f.node, attr)
+}
+
+// Sync implements SyncHandle. There is no stable storage so it only returns
+// nil
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// Close implements io.Closer
+func (f *memFile) Close() error {
+	return nil
+}
+
+// memDir is a directory opened by MemoryHandler. It holds a snapshot of the
+// directory entries taken when the directory was opened
+type memDir struct {
+	list []os.FileInfo
+}
+
+// ReadDir implements DirHandle
+func (d *memDir) ReadDir(n int) ([]os.FileInfo, error) {
+	if len(d.list) == 0 {
+		return nil, io.EOF
+	}
+
+	if n <= 0 || n > len(d.list) {
+		n = len(d.list)
+	}
+
+	list := d.list[:n]
+	d.list = d.list[n:]
+
+	return list, nil
+}
+
+// Close implements io.Closer
+func (d *memDir) Close() error {
+	return nil
+}
+
+// splitPath returns the non-empty elements of the cleaned absolute form of p
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+
+	return strings.Split(p[1:], "/")
+}
@@ -0,0 +1,147 @@
+package sftp
+
+import (
+	"os"
+	"time"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// POSIX file type and mode bits as used within the permissions field of SFTP
+// file attributes
+const (
+	modeTypeMask = 0170000 // S_IFMT
+	modeSocket   = 0140000 // S_IFSOCK
+	modeSymlink  = 0120000 // S_IFLNK
+	modeRegular  = 0100000 // S_IFREG
+	modeBlock    = 0060000 // S_IFBLK
+	modeDir      = 0040000 // S_IFDIR
+	modeChar     = 0020000 // S_IFCHR
+	modeFIFO     = 0010000 // S_IFIFO
+
+	modeSetuid = 0004000 // S_ISUID
+	modeSetgid = 0002000 // S_ISGID
+	modeSticky = 0001000 // S_ISVTX
+
+	modePerm = 0000777
+)
+
+// ToFileMode converts the POSIX permission word of SFTP file attributes into
+// an os.FileMode
+func ToFileMode(perm uint32) os.FileMode {
+	mode := os.FileMode(perm & modePerm)
+
+	switch perm & modeTypeMask {
+	case modeSocket:
+		mode |= os.ModeSocket
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	case modeBlock:
+		mode |= os.ModeDevice
+	case modeDir:
+		mode |= os.ModeDir
+	case modeChar:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case modeFIFO:
+		mode |= os.ModeNamedPipe
+	}
+
+	if perm&modeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+
+	if perm&modeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+
+	if perm&modeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+// FromFileMode converts mode into the POSIX permission word used within SFTP
+// file attributes
+func FromFileMode(mode os.FileMode) uint32 {
+	perm := uint32(mode & os.ModePerm)
+
+	switch {
+	case mode&os.ModeSocket != 0:
+		perm |= modeSocket
+	case mode&os.ModeSymlink != 0:
+		perm |= modeSymlink
+	case mode&os.ModeCharDevice != 0:
+		perm |= modeChar
+	case mode&os.ModeDevice != 0:
+		perm |= modeBlock
+	case mode&os.ModeDir != 0:
+		perm |= modeDir
+	case mode&os.ModeNamedPipe != 0:
+		perm |= modeFIFO
+	default:
+		perm |= modeRegular
+	}
+
+	if mode&os.ModeSetuid != 0 {
+		perm |= modeSetuid
+	}
+
+	if mode&os.ModeSetgid != 0 {
+		perm |= modeSetgid
+	}
+
+	if mode&os.ModeSticky != 0 {
+		perm |= modeSticky
+	}
+
+	return perm
+}
+
+// permAttr returns SFTP file attributes that carry the permission bits of
+// mode. The file type is not included as servers are not expected to change
+// it
+func permAttr(mode os.FileMode) sshfxp.Attr {
+	return sshfxp.Attr{
+		Flags:       sshfxp.FlagAttrPermissions,
+		Permissions: FromFileMode(mode) &^ modeTypeMask,
+	}
+}
+
+// ownerAttr returns SFTP file attributes that carry the numeric user and group
+// ID
+func ownerAttr(uid, gid int) sshfxp.Attr {
+	return sshfxp.Attr{
+		Flags: sshfxp.FlagAttrUidGid,
+		UID:   uint32(uid),
+		GID:   uint32(gid),
+	}
+}
+
+// timesAttr returns SFTP file attributes that carry the access and
+// modification time
+func timesAttr(atime, mtime time.Time) sshfxp.Attr {
+	return sshfxp.Attr{
+		Flags: sshfxp.FlagAttrAcModTime,
+		ATime: uint32(atime.Unix()),
+		MTime: uint32(mtime.Unix()),
+	}
+}
+
+// sizeAttr returns SFTP file attributes that carry the file size
+func sizeAttr(size int64) sshfxp.Attr {
+	return sshfxp.Attr{
+		Flags: sshfxp.FlagAttrSize,
+		Size:  uint64(size),
+	}
+}
+
+// fileInfoAttr returns SFTP file attributes for the os.FileInfo fi. Only the
+// permission bits are used. If fi is nil, empty attributes are returned
+func fileInfoAttr(fi os.FileInfo) sshfxp.Attr {
+	if fi == nil {
+		return sshfxp.Attr{}
+	}
+
+	return permAttr(fi.Mode())
+}
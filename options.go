@@ -0,0 +1,117 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// MaxPacketLimit is the largest value accepted by MaxPacket. Servers are only
+// required to accept packets of up to 34000 bytes, but most of them accept
+// considerably more
+const MaxPacketLimit = 256 * 1024
+
+// ClientOption configures a Client created by NewClientPipe
+type ClientOption func(*Client) error
+
+// WithLogger configures the logger used by the client. It defaults to the
+// standard logrus logger
+func WithLogger(log logrus.FieldLogger) ClientOption {
+	return func(cli *Client) error {
+		if log == nil {
+			return errors.New("logger must not be nil")
+		}
+
+		cli.log = log
+		return nil
+	}
+}
+
+// MaxPacket sets the maximum number of data bytes sent or requested by a
+// single read or write request. Smaller limits announced by the server take
+// precedence. By default the limits announced by the server are used, up to
+// MaxPacketLimit, or DefaultLimits if the server does not announce any
+func MaxPacket(size int) ClientOption {
+	return func(cli *Client) error {
+		if size <= 0 || size > MaxPacketLimit {
+			return fmt.Errorf("max packet size must be between 1 and %d bytes, got %d", MaxPacketLimit, size)
+		}
+
+		cli.chunkSize = size
+		return nil
+	}
+}
+
+// MaxConcurrentRequests sets the number of read or write requests kept in
+// flight for a single file transfer. By default it is derived from the size
+// of reads and writes, see DefaultConcurrency
+func MaxConcurrentRequests(n int) ClientOption {
+	return func(cli *Client) error {
+		if n <= 0 {
+			return fmt.Errorf("number of concurrent requests must be positive, got %d", n)
+		}
+
+		cli.concurrency = n
+		return nil
+	}
+}
+
+// HandshakeTimeout limits the time waited for the server to answer the
+// initial SSH_FXP_INIT. A zero timeout, the default, waits forever
+func HandshakeTimeout(d time.Duration) ClientOption {
+	return func(cli *Client) error {
+		if d < 0 {
+			return fmt.Errorf("handshake timeout must not be negative, got %s", d)
+		}
+
+		cli.handshakeTimeout = d
+		return nil
+	}
+}
+
+// RequestExtension adds the extension name with data to the SSH_FXP_INIT
+// packet sent to the server
+func RequestExtension(name, data string) ClientOption {
+	return func(cli *Client) error {
+		if name == "" {
+			return errors.New("extension name must not be empty")
+		}
+
+		cli.extensions = append(cli.extensions, struct {
+			Name string
+			Data string
+		}{name, data})
+		return nil
+	}
+}
+
+// WithSymlinkOrder configures the argument order used by Symlink. It defaults
+// to SymlinkOpenSSH. Servers do not announce the order they expect, so it can
+// not be detected, but almost all of them follow OpenSSH
+func WithSymlinkOrder(order SymlinkOrder) ClientOption {
+	return func(cli *Client) error {
+		switch order {
+		case SymlinkOpenSSH, SymlinkStandard:
+		default:
+			return fmt.Errorf("invalid symlink order %d", order)
+		}
+
+		cli.symlinkOrder = order
+		return nil
+	}
+}
+
+// ReplaceOnRename configures Rename to replace an existing destination. The
+// posix-rename@openssh.com extension is used if the server supports it.
+// Otherwise the destination is moved aside and restored if renaming fails.
+// This fallback only replaces files with files and, unlike posix-rename, is
+// not atomic: the destination is missing for a short time and concurrent
+// changes by other clients may interfere with it
+func ReplaceOnRename() ClientOption {
+	return func(cli *Client) error {
+		cli.renameReplace = true
+		return nil
+	}
+}
@@ -4,17 +4,31 @@ import (
 	"io"
 	"sync"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/nethack42/go-sftp/sshfxp"
 )
 
+var (
+	// DefaultChunkSize is the number of bytes requested or sent by a single
+	// SSH_FXP_READ or SSH_FXP_WRITE packet of NewFileReader and
+	// NewFileWriter. Most servers limit reads to 32KiB or more
+	DefaultChunkSize = 32 * 1024
+
+	// DefaultConcurrency is the number of read or write requests of
+	// DefaultChunkSize bytes kept in flight for a single transfer. Clients
+	// using larger requests keep fewer of them in flight
+	DefaultConcurrency = 64
+)
+
 type FileReader struct {
 	cli ClientConn
 
 	handle string
 
-	pipe_read  io.Reader
-	pipe_write io.WriteCloser
+	chunkSize   int
+	concurrency int
+
+	pipe_read  *io.PipeReader
+	pipe_write *io.PipeWriter
 
 	wg sync.WaitGroup
 }
@@ -23,50 +37,172 @@ func (fr *FileReader) Read(p []byte) (int, error) {
 	return fr.pipe_read.Read(p)
 }
 
+// Close stops reading the remote file and releases the file handle
+func (fr *FileReader) Close() error {
+	fr.pipe_read.Close()
+	fr.wg.Wait()
+
+	return nil
+}
+
 func (fr *FileReader) fetch() {
 	defer fr.wg.Done()
-	defer fr.pipe_write.Close()
+	defer fr.cli.CloseHandle(fr.handle)
 
-	var length uint64 = 0
+	_, err := readAhead(fr.cli, fr.handle, 0, -1, fr.chunkSize, fr.concurrency, fr.pipe_write)
 
-	for {
-		buf, err := fr.cli.Read(fr.handle, length, 1024*1024)
-		if err != nil {
-			if e, ok := err.(*sshfxp.FxpStatusError); ok && e.Code == sshfxp.StatusEOF {
-				break
-			}
-			logrus.Errorf("file reader closed! %v", err)
-			break
-		}
-
-		n, err := fr.pipe_write.Write(buf)
-		if n == 0 || err != nil {
-			logrus.Errorf("file reader closed! %v", err)
-			break
-		}
+	fr.pipe_write.CloseWithError(err)
+}
 
-		length += uint64(n)
-	}
+// NewFileReader opens the file identified by path and returns an
+// io.ReadCloser that fetches the file contents using DefaultChunkSize and
+// DefaultConcurrency. Close releases the remote file handle
+func NewFileReader(path string, cli ClientConn) (io.ReadCloser, error) {
+	return NewFileReaderSize(path, cli, DefaultChunkSize, DefaultConcurrency)
 }
 
-func NewFileReader(path string, cli ClientConn) (io.Reader, error) {
+// NewFileReaderSize opens the file identified by path and returns an
+// io.ReadCloser that fetches the file contents ahead of time by keeping up to
+// concurrency read requests of chunkSize bytes in flight
+func NewFileReaderSize(path string, cli ClientConn, chunkSize, concurrency int) (io.ReadCloser, error) {
 	handle, err := cli.Open(path, sshfxp.OpenRead, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	reader := &FileReader{
-		cli:    cli,
-		handle: handle,
+		cli:         cli,
+		handle:      handle,
+		chunkSize:   chunkSize,
+		concurrency: concurrency,
 	}
 
-	in, out := io.Pipe()
-
-	reader.pipe_read = in
-	reader.pipe_write = out
+	reader.pipe_read, reader.pipe_write = io.Pipe()
 
 	reader.wg.Add(1)
 	go reader.fetch()
 
 	return reader, nil
 }
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+type readRequest struct {
+	offset uint64
+	length int
+	res    chan readResult
+}
+
+// readAhead reads length bytes of the file identified by handle starting at
+// offset and writes them in order to w. If length is negative, readAhead reads
+// until the end of the file. Up to concurrency read requests of at most
+// chunkSize bytes are kept in flight. Short reads are completed by requesting
+// the remaining data before any later chunk is written. As the server likely
+// limits the size of reads then, later requests use the shorter size and more
+// of them are kept in flight to request the same number of bytes at once, up
+// to the larger of concurrency and DefaultConcurrency. Reaching the end of the
+// file is not treated as an error. readAhead returns the number of bytes
+// written to w
+func readAhead(cli ClientConn, handle string, offset uint64, length int64, chunkSize, concurrency int, w io.Writer) (int64, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	window := chunkSize * concurrency
+
+	maxConcurrency := concurrency
+	if DefaultConcurrency > maxConcurrency {
+		maxConcurrency = DefaultConcurrency
+	}
+
+	issue := func(offset uint64, length int) *readRequest {
+		req := &readRequest{
+			offset: offset,
+			length: length,
+			res:    make(chan readResult, 1),
+		}
+
+		go func() {
+			data, err := cli.Read(handle, req.offset, uint32(req.length))
+			req.res <- readResult{data, err}
+		}()
+
+		return req
+	}
+
+	var (
+		queue   []*readRequest
+		next    = offset
+		end     = offset + uint64(length)
+		written int64
+	)
+
+	for {
+		for len(queue) < concurrency && (length < 0 || next < end) {
+			n := chunkSize
+			if length >= 0 && end-next < uint64(n) {
+				n = int(end - next)
+			}
+
+			queue = append(queue, issue(next, n))
+			next += uint64(n)
+		}
+
+		if len(queue) == 0 {
+			return written, nil
+		}
+
+		req := queue[0]
+		queue = queue[1:]
+
+		res := <-req.res
+		if res.err != nil {
+			if sshfxp.IsEOF(res.err) {
+				// all requests following this one are past the end of the
+				// file as well
+				return written, nil
+			}
+
+			return written, res.err
+		}
+
+		if len(res.data) == 0 {
+			// the end of the file is reported with SSH_FX_EOF
+			return written, io.ErrUnexpectedEOF
+		}
+
+		if len(res.data) > req.length {
+			res.data = res.data[:req.length]
+		}
+
+		n, err := w.Write(res.data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		if len(res.data) < req.length {
+			// The server returned less data than requested. Fetch the rest of
+			// the chunk before anything else and assume that the server
+			// limits the size of reads
+			rest := issue(req.offset+uint64(len(res.data)), req.length-len(res.data))
+			queue = append([]*readRequest{rest}, queue...)
+
+			if len(res.data) < chunkSize {
+				chunkSize = len(res.data)
+
+				concurrency = window / chunkSize
+				if concurrency > maxConcurrency {
+					concurrency = maxConcurrency
+				}
+			}
+		}
+	}
+}
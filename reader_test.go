@@ -0,0 +1,152 @@
+package sftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// shortReadHandler serves files returning at most max bytes per read
+type shortReadHandler struct {
+	*MemoryHandler
+
+	max int
+}
+
+func (h *shortReadHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	f, err := h.MemoryHandler.Open(p, flag, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shortReadFile{f, h.max}, nil
+}
+
+type shortReadFile struct {
+	FileHandle
+
+	max int
+}
+
+func (f *shortReadFile) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > f.max {
+		p = p[:f.max]
+	}
+
+	return f.FileHandle.ReadAt(p, off)
+}
+
+func TestShortReads(t *testing.T) {
+	cli, err := NewLoopbackClient(&shortReadHandler{MemoryHandler: NewMemoryHandler(), max: 1000}, MaxPacket(4096))
+	if err != nil {
+		t.Fatalf("NewLoopbackClient: %s", err)
+	}
+	defer cli.Close()
+
+	if cli.readSize != 4096 {
+		t.Fatalf("client uses %d byte reads, expected 4096", cli.readSize)
+	}
+
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	putFile(t, cli, "/file", string(data))
+
+	r, err := cli.FileReader("/file")
+	if err != nil {
+		t.Fatalf("FileReader: %s", err)
+	}
+
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("ReadAll returned %d bytes, %v", len(read), err)
+	}
+
+	f, err := cli.OpenFile("/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 20000)
+	if n, err := f.ReadAt(buf, 12345); err != nil || !bytes.Equal(buf[:n], data[12345:12345+20000]) {
+		t.Errorf("ReadAt returned %d bytes, %v", n, err)
+	}
+
+	buf = make([]byte, 50000)
+	if n, err := f.ReadAt(buf, 10000); err != io.EOF || !bytes.Equal(buf[:n], data[10000:]) {
+		t.Errorf("ReadAt beyond the end of the file returned %d bytes, %v", n, err)
+	}
+
+	var out bytes.Buffer
+	if n, err := f.WriteTo(&out); err != nil || n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("WriteTo returned %d bytes, %v", n, err)
+	}
+}
+
+// slowReadConn serves reads of data returning at most max bytes after a delay
+// and records the number of concurrent reads
+type slowReadConn struct {
+	ClientConn
+
+	data []byte
+	max  int
+
+	m           sync.Mutex
+	inflight    int
+	maxInflight int
+}
+
+func (c *slowReadConn) Read(handle string, offset uint64, length uint32) ([]byte, error) {
+	c.m.Lock()
+	c.inflight++
+	if c.inflight > c.maxInflight {
+		c.maxInflight = c.inflight
+	}
+	c.m.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	c.m.Lock()
+	c.inflight--
+	c.m.Unlock()
+
+	if offset >= uint64(len(c.data)) {
+		return nil, &sshfxp.FxpStatusError{Code: sshfxp.StatusEOF}
+	}
+
+	end := offset + uint64(length)
+	if max := offset + uint64(c.max); end > max {
+		end = max
+	}
+
+	if end > uint64(len(c.data)) {
+		end = uint64(len(c.data))
+	}
+
+	return c.data[offset:end], nil
+}
+
+func TestReadAheadShortReadConcurrency(t *testing.T) {
+	conn := &slowReadConn{data: bytes.Repeat([]byte("0123456789"), 5000), max: 1000}
+
+	var out bytes.Buffer
+	n, err := readAhead(conn, "handle", 0, -1, 4096, 2, &out)
+	if err != nil || n != int64(len(conn.data)) || !bytes.Equal(out.Bytes(), conn.data) {
+		t.Fatalf("readAhead returned %d bytes, %v", n, err)
+	}
+
+	// two requests of 4096 bytes are as many bytes as eight of 1000 bytes
+	if conn.maxInflight <= 2 || conn.maxInflight > 8 {
+		t.Errorf("readAhead kept up to %d reads in flight after reads were shortened, expected up to 8", conn.maxInflight)
+	}
+}
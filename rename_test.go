@@ -0,0 +1,152 @@
+package sftp
+
+import (
+	"errors"
+	"testing"
+)
+
+// noPosixRename hides the PosixRenamer implementation of a Handler
+type noPosixRename struct {
+	Handler
+}
+
+func newRenameClient(t *testing.T, h Handler, opts ...ClientOption) *Client {
+	t.Helper()
+
+	cli, err := NewLoopbackClient(h, opts...)
+	if err != nil {
+		t.Fatalf("NewLoopbackClient: %s", err)
+	}
+
+	t.Cleanup(func() { cli.Close() })
+
+	return cli
+}
+
+// assertNames fails if the root directory does not hold exactly names
+func assertNames(t *testing.T, cli *Client, names ...string) {
+	t.Helper()
+
+	list, err := cli.List("/")
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+
+	found := make(map[string]bool)
+	for _, fi := range list {
+		found[fi.Name()] = true
+	}
+
+	for _, name := range names {
+		if !found[name] {
+			t.Errorf("%s is missing", name)
+		}
+		delete(found, name)
+	}
+
+	for name := range found {
+		t.Errorf("unexpected entry %s", name)
+	}
+}
+
+func TestRenameExisting(t *testing.T) {
+	cli := newRenameClient(t, NewMemoryHandler())
+
+	putFile(t, cli, "/a", "a")
+	putFile(t, cli, "/b", "b")
+
+	if err := cli.Rename("/a", "/b"); err == nil {
+		t.Error("Rename replaced an existing file")
+	}
+
+	assertNames(t, cli, "a", "b")
+}
+
+func TestPosixRename(t *testing.T) {
+	cli := newRenameClient(t, NewMemoryHandler())
+
+	putFile(t, cli, "/a", "a")
+	putFile(t, cli, "/b", "b")
+
+	if err := cli.PosixRename("/a", "/b"); err != nil {
+		t.Fatalf("PosixRename: %s", err)
+	}
+
+	assertNames(t, cli, "b")
+
+	if got := getFile(t, cli, "/b"); got != "a" {
+		t.Errorf("/b holds %q after PosixRename", got)
+	}
+}
+
+func TestPosixRenameUnsupported(t *testing.T) {
+	cli := newRenameClient(t, noPosixRename{NewMemoryHandler()})
+
+	putFile(t, cli, "/a", "a")
+
+	if err := cli.PosixRename("/a", "/b"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("PosixRename returned %v, expected ErrUnsupported", err)
+	}
+}
+
+func TestReplaceOnRename(t *testing.T) {
+	for name, h := range map[string]Handler{
+		"posix-rename": NewMemoryHandler(),
+		"fallback":     noPosixRename{NewMemoryHandler()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cli := newRenameClient(t, h, ReplaceOnRename())
+
+			putFile(t, cli, "/a", "a")
+			putFile(t, cli, "/b", "b")
+
+			if err := cli.Rename("/a", "/b"); err != nil {
+				t.Fatalf("Rename: %s", err)
+			}
+
+			if got := getFile(t, cli, "/b"); got != "a" {
+				t.Errorf("/b holds %q after Rename", got)
+			}
+
+			if err := cli.Rename("/b", "/c"); err != nil {
+				t.Fatalf("Rename to a new name: %s", err)
+			}
+
+			assertNames(t, cli, "c")
+		})
+	}
+}
+
+func TestReplaceOnRenameFallbackDirectories(t *testing.T) {
+	cli := newRenameClient(t, noPosixRename{NewMemoryHandler()}, ReplaceOnRename())
+
+	putFile(t, cli, "/file", "file")
+
+	if err := cli.MkDir("/dir", nil); err != nil {
+		t.Fatalf("MkDir: %s", err)
+	}
+
+	putFile(t, cli, "/dir/data", "data")
+
+	if err := cli.Rename("/file", "/dir"); err == nil {
+		t.Error("Rename replaced a directory with a file")
+	}
+
+	if err := cli.Rename("/dir", "/file"); err == nil {
+		t.Error("Rename replaced a file with a directory")
+	}
+
+	if err := cli.Rename("/missing", "/file"); err == nil {
+		t.Error("Rename of a missing file succeeded")
+	}
+
+	assertNames(t, cli, "file", "dir")
+
+	if got := getFile(t, cli, "/dir/data"); got != "data" {
+		t.Errorf("/dir/data holds %q", got)
+	}
+
+	if got := getFile(t, cli, "/file"); got != "file" {
+		t.Errorf("/file holds %q", got)
+	}
+}
@@ -7,24 +7,47 @@ import (
 	"github.com/nethack42/go-sftp/sshfxp"
 )
 
+// maxCancelled is the number of cancelled requests whose late responses are
+// expected. Beyond it the oldest cancelled request is forgotten, so that a
+// server never answering does not grow the router without bounds
+const maxCancelled = 4096
+
 type Router struct {
 	m sync.Mutex
 
 	routes map[uint32]chan<- sshfxp.Message
 
+	// cancelled holds the IDs of requests that have been given up by the
+	// caller but may still receive a response, mapped to the order they
+	// have been cancelled in. Their IDs are not handed out again
+	cancelled   map[uint32]uint64
+	cancelCount uint64
+
 	nextID uint32
+
+	// err is set once the router failed and does not accept new requests
+	err error
 }
 
 func NewRouter() *Router {
 	return &Router{
-		routes: make(map[uint32]chan<- sshfxp.Message),
+		routes:    make(map[uint32]chan<- sshfxp.Message),
+		cancelled: make(map[uint32]uint64),
 	}
 }
 
-func (r *Router) Get() (uint32, <-chan sshfxp.Message) {
+// Get allocates a new request ID and returns it together with the channel
+// receiving the response. If the router has failed, its error is returned.
+// The channel is closed without a response if the router fails while the
+// request is pending
+func (r *Router) Get() (uint32, <-chan sshfxp.Message, error) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+
 	var id uint32
 
 	ch := make(chan sshfxp.Message, 1)
@@ -38,12 +61,16 @@ func (r *Router) Get() (uint32, <-chan sshfxp.Message) {
 			continue
 		}
 
+		if _, ok := r.cancelled[id]; ok {
+			continue
+		}
+
 		break
 	}
 
 	r.routes[id] = ch
 
-	return id, ch
+	return id, ch, nil
 }
 
 func (r *Router) Resolve(payload interface{}) error {
@@ -63,11 +90,81 @@ func (r *Router) Resolve(payload interface{}) error {
 
 	if res, ok := r.routes[x.GetID()]; ok {
 		delete(r.routes, x.GetID())
-		go func() {
-			res <- payload.(sshfxp.Message)
-		}()
+
+		// the channel is buffered and receives exactly one message
+		res <- payload.(sshfxp.Message)
+		return nil
+	}
+
+	if _, ok := r.cancelled[x.GetID()]; ok {
+		// late response for a cancelled request
+		delete(r.cancelled, x.GetID())
 		return nil
 	}
 
 	return errors.New("unknown id")
 }
+
+// Cancel releases the route for id. A response arriving later for id is
+// silently discarded by Resolve, unless more than maxCancelled requests have
+// been cancelled since
+func (r *Router) Cancel(id uint32) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if _, ok := r.routes[id]; !ok {
+		return
+	}
+
+	delete(r.routes, id)
+
+	if len(r.cancelled) >= maxCancelled {
+		r.forgetOldestCancelled()
+	}
+
+	r.cancelCount++
+	r.cancelled[id] = r.cancelCount
+}
+
+// forgetOldestCancelled removes the request cancelled first from the
+// cancelled requests
+func (r *Router) forgetOldestCancelled() {
+	var (
+		oldest uint32
+		min    uint64
+	)
+
+	for id, n := range r.cancelled {
+		if min == 0 || n < min {
+			oldest, min = id, n
+		}
+	}
+
+	delete(r.cancelled, oldest)
+}
+
+// Fail fails all pending requests by closing their channels. Any further call
+// to Get returns err
+func (r *Router) Fail(err error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.err != nil {
+		return
+	}
+
+	r.err = err
+
+	for id, ch := range r.routes {
+		close(ch)
+		delete(r.routes, id)
+	}
+}
+
+// Err returns the error passed to Fail or nil
+func (r *Router) Err() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.err
+}
@@ -0,0 +1,58 @@
+package sftp
+
+import (
+	"testing"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+func TestRouterCancel(t *testing.T) {
+	r := NewRouter()
+
+	id, _, err := r.Get()
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	r.Cancel(id)
+
+	// the ID is not reused while a late response may arrive
+	r.nextID = id
+	if next, _, _ := r.Get(); next == id {
+		t.Errorf("Get reused the ID %d of a cancelled request", id)
+	}
+
+	if err := r.Resolve(&sshfxp.Status{ID: id}); err != nil {
+		t.Errorf("late response of a cancelled request: %s", err)
+	}
+
+	if err := r.Resolve(&sshfxp.Status{ID: id}); err == nil {
+		t.Error("a second response for a cancelled request has been accepted")
+	}
+}
+
+func TestRouterCancelBounded(t *testing.T) {
+	r := NewRouter()
+
+	var first uint32
+	for i := 0; i < 2*maxCancelled; i++ {
+		id, _, err := r.Get()
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+
+		if i == 0 {
+			first = id
+		}
+
+		r.Cancel(id)
+	}
+
+	if len(r.cancelled) != maxCancelled {
+		t.Errorf("router remembers %d cancelled requests, expected %d", len(r.cancelled), maxCancelled)
+	}
+
+	if _, ok := r.cancelled[first]; ok {
+		t.Error("the oldest cancelled request has not been forgotten")
+	}
+}
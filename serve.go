@@ -15,11 +15,14 @@ var (
 	DumpRxPackets = false
 )
 
-func readConn(r io.Reader, ch chan<- sshfxp.Packet) error {
+// readConn reads packets from r and forwards them to ch until reading fails
+// or done is closed. Packets longer than maxLength bytes are treated as an
+// error unless maxLength is zero
+func readConn(r io.Reader, ch chan<- sshfxp.Packet, done <-chan struct{}, maxLength uint32) error {
 	for {
 		var pkt sshfxp.Packet
 
-		if err := pkt.Read(r); err != nil {
+		if err := pkt.ReadLimit(r, maxLength); err != nil {
 			return err
 		}
 
@@ -32,13 +35,25 @@ func readConn(r io.Reader, ch chan<- sshfxp.Packet) error {
 			fmt.Fprintf(os.Stderr, print("<<<<<<<<<< receive (type=%d len=%d)\n%s<<<<<<<<<<\n", pkt.Type, pkt.Length, hex))
 		}
 
-		ch <- pkt
+		select {
+		case ch <- pkt:
+		case <-done:
+			return nil
+		}
 	}
-	return nil
 }
 
-func writeConn(w io.Writer, ch <-chan sshfxp.Packet) error {
-	for pkt := range ch {
+// writeConn writes all packets received on ch to w until writing fails or done
+// is closed
+func writeConn(w io.Writer, ch <-chan sshfxp.Packet, done <-chan struct{}) error {
+	for {
+		var pkt sshfxp.Packet
+
+		select {
+		case pkt = <-ch:
+		case <-done:
+			return nil
+		}
 
 		blob, err := pkt.Bytes()
 		if err != nil {
@@ -56,5 +71,4 @@ func writeConn(w io.Writer, ch <-chan sshfxp.Packet) error {
 			return err
 		}
 	}
-	return nil
 }
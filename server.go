@@ -0,0 +1,744 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+var (
+	// DefaultReadDirBatch is the maximum number of directory entries returned
+	// by the server for a single SSH_FXP_READDIR request
+	DefaultReadDirBatch = 128
+
+	// DefaultMaxReadLength is the maximum number of bytes returned by the
+	// server for a single SSH_FXP_READ request. Larger reads are shortened
+	DefaultMaxReadLength = 256 * 1024
+
+	// DefaultMaxWriteLength is the maximum number of bytes clients are told
+	// to send in a single SSH_FXP_WRITE request by limits@openssh.com.
+	// Together with DefaultMaxReadLength it determines the longest packet
+	// accepted by the server, see maxPacketLength
+	DefaultMaxWriteLength = 256 * 1024
+)
+
+// maxPacketLength returns the length of the longest packet accepted by the
+// server. Clients sending longer packets are disconnected
+func maxPacketLength() uint32 {
+	maxData := DefaultMaxReadLength
+	if DefaultMaxWriteLength > maxData {
+		maxData = DefaultMaxWriteLength
+	}
+
+	return uint32(maxData + packetOverhead)
+}
+
+// ServerOption configures a Server created by NewServer
+type ServerOption func(*Server) error
+
+// WithServerLogger configures the logger used by the server. It defaults to
+// the standard logrus logger
+func WithServerLogger(log logrus.FieldLogger) ServerOption {
+	return func(srv *Server) error {
+		if log == nil {
+			return errors.New("logger must not be nil")
+		}
+
+		srv.log = log
+		return nil
+	}
+}
+
+// WithExtension adds the extension name with data to the SSH_FXP_VERSION
+// packet sent to clients. Handling requests for the extension is up to the
+// caller
+func WithExtension(name, data string) ServerOption {
+	return func(srv *Server) error {
+		if name == "" {
+			return errors.New("extension name must not be empty")
+		}
+
+		srv.extensions = append(srv.extensions, struct {
+			Name string
+			Data string
+		}{name, data})
+		return nil
+	}
+}
+
+// ExtensionHandler serves the SSH_FXP_EXTENDED requests of an extension. It
+// returns the payload of the SSH_FXP_EXTENDED_REPLY response or nil to answer
+// with SSH_FX_OK. Errors are reported to the client like Handler errors
+type ExtensionHandler func(srv *Server, req *sshfxp.Extended) (sshfxp.Writer, error)
+
+// HandleExtension registers fn for serving requests of the extension name
+// and advertises the extension with data to clients
+func HandleExtension(name, data string, fn ExtensionHandler) ServerOption {
+	return func(srv *Server) error {
+		if fn == nil {
+			return errors.New("extension handler must not be nil")
+		}
+
+		if err := WithExtension(name, data)(srv); err != nil {
+			return err
+		}
+
+		if srv.extHandlers == nil {
+			srv.extHandlers = make(map[string]ExtensionHandler)
+		}
+
+		srv.extHandlers[name] = fn
+		return nil
+	}
+}
+
+// ReadOnly configures the server to reject all requests that would modify
+// the file system with SSH_FX_PERMISSION_DENIED
+func ReadOnly() ServerOption {
+	return func(srv *Server) error {
+		srv.readOnly = true
+		return nil
+	}
+}
+
+// Server serves a single SFTP session by dispatching client requests to a
+// Handler. Requests are processed one after another in the order they are
+// received
+type Server struct {
+	reader  io.Reader
+	writer  io.Writer
+	handler Handler
+
+	log      logrus.FieldLogger
+	readOnly bool
+
+	outgoing chan sshfxp.Packet
+	done     chan struct{}
+
+	handlesM   sync.Mutex
+	handles    map[string]interface{}
+	dirPaths   map[string]string
+	nextHandle uint64
+
+	version    uint32
+	extensions []struct {
+		Name string
+		Data string
+	}
+	extHandlers map[string]ExtensionHandler
+}
+
+// NewServer creates a new SFTP server reading requests from r, writing
+// responses to w and serving them using handler. Call Serve to start
+// processing requests
+func NewServer(r io.Reader, w io.Writer, handler Handler, opts ...ServerOption) (*Server, error) {
+	if handler == nil {
+		return nil, errors.New("handler must not be nil")
+	}
+
+	srv := &Server{
+		reader:   r,
+		writer:   w,
+		handler:  handler,
+		log:      logrus.StandardLogger(),
+		outgoing: make(chan sshfxp.Packet),
+		done:     make(chan struct{}),
+		handles:  make(map[string]interface{}),
+		dirPaths: make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		if err := opt(srv); err != nil {
+			return nil, fmt.Errorf("invalid option: %s", err)
+		}
+	}
+
+	srv.builtinExtensions()
+
+	return srv, nil
+}
+
+// Handler returns the Handler serving the session
+func (srv *Server) Handler() Handler {
+	return srv.handler
+}
+
+// File returns the file opened by the client as handle. It is meant for
+// extension handlers operating on handles
+func (srv *Server) File(handle string) (FileHandle, error) {
+	return srv.fileHandle(handle)
+}
+
+// IsReadOnly returns true if the server has been configured with ReadOnly.
+// Extension handlers modifying the file system should reject requests in
+// this case
+func (srv *Server) IsReadOnly() bool {
+	return srv.readOnly
+}
+
+// Serve processes requests until the client closes the connection or reading
+// or writing fails. All handles still open are closed before Serve returns.
+// A connection closed by the client is not reported as an error
+func (srv *Server) Serve() error {
+	incoming := make(chan sshfxp.Packet)
+	errch := make(chan error, 2) // one error per goroutine
+
+	go func() {
+		errch <- readConn(srv.reader, incoming, srv.done, maxPacketLength())
+	}()
+
+	go func() {
+		errch <- writeConn(srv.writer, srv.outgoing, srv.done)
+	}()
+
+	err := srv.serve(incoming, errch)
+
+	close(srv.done)
+	srv.closeHandles()
+
+	// unblock the reader if possible. Otherwise it exits once the pending
+	// read returns
+	if rc, ok := srv.reader.(io.Closer); ok {
+		rc.Close()
+	}
+
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+func (srv *Server) serve(incoming <-chan sshfxp.Packet, errch <-chan error) error {
+	for {
+		select {
+		case pkt := <-incoming:
+			if err := srv.handlePacket(pkt); err != nil {
+				return err
+			}
+
+		case err := <-errch:
+			if err == nil {
+				err = io.EOF
+			}
+
+			return err
+		}
+	}
+}
+
+// handlePacket handles a single request and sends the response
+func (srv *Server) handlePacket(pkt sshfxp.Packet) error {
+	if pkt.Type == sshfxp.TypeInit {
+		return srv.handleInit(pkt)
+	}
+
+	if srv.version == 0 {
+		return fmt.Errorf("unexpected packet type %d before SSH_FXP_INIT", pkt.Type)
+	}
+
+	msg, err := pkt.Decode()
+	if err != nil {
+		// we still try to answer the request so the client does not wait
+		// forever. All requests start with their ID
+		if len(pkt.Payload) < 4 {
+			return fmt.Errorf("failed to decode packet: %s", err)
+		}
+
+		srv.log.Debugf("failed to decode packet of type %d: %s", pkt.Type, err)
+
+		id := binary.BigEndian.Uint32(pkt.Payload)
+		code := uint32(sshfxp.StatusBadMessage)
+		if pkt.Type > sshfxp.TypeSymlink {
+			code = sshfxp.StatusOpUnsupported
+		}
+
+		return srv.send(&sshfxp.Status{
+			ID:      id,
+			Error:   code,
+			Message: err.Error(),
+		})
+	}
+
+	header, ok := msg.(sshfxp.Header)
+	if !ok {
+		return fmt.Errorf("unexpected packet type %d", pkt.Type)
+	}
+
+	var resp sshfxp.Message
+	if srv.readOnly && isModifying(msg) {
+		resp = &sshfxp.Status{
+			Error:   sshfxp.StatusPermissionDenied,
+			Message: "read-only server",
+		}
+	} else {
+		resp = srv.handleRequest(msg)
+	}
+	if h, ok := resp.(sshfxp.Header); ok {
+		h.SetID(header.GetID())
+	}
+
+	return srv.send(resp)
+}
+
+func (srv *Server) handleInit(pkt sshfxp.Packet) error {
+	if srv.version != 0 {
+		return errors.New("received SSH_FXP_INIT twice")
+	}
+
+	msg, err := pkt.Decode()
+	if err != nil {
+		return err
+	}
+
+	init := msg.(*sshfxp.Init)
+
+	srv.version = 3
+	if init.Version < srv.version {
+		return fmt.Errorf("unsupported SFTP version %d", init.Version)
+	}
+
+	srv.log.Debugf("SFTP client requested version %d, using %d", init.Version, srv.version)
+
+	for _, ext := range init.Extensions {
+		srv.log.Debugf("SFTP client requested extension %s (%s)", ext.Name, ext.Data)
+	}
+
+	return srv.send(&sshfxp.Version{
+		Version:    srv.version,
+		Extensions: srv.extensions,
+	})
+}
+
+// handleRequest dispatches msg to the handler and returns the response
+func (srv *Server) handleRequest(msg sshfxp.Message) sshfxp.Message {
+	h := srv.handler
+
+	switch req := msg.(type) {
+	case *sshfxp.Open:
+		attr, err := newFileAttr(req.Attributes)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		f, err := h.Open(req.Filename, osFlags(req.PFlags), attr)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		return &sshfxp.Handle{Handle: srv.addHandle(f)}
+
+	case *sshfxp.OpenDir:
+		d, err := h.OpenDir(req.Path)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		return &sshfxp.Handle{Handle: srv.addDirHandle(d, req.Path)}
+
+	case *sshfxp.Close:
+		return statusResponse(srv.closeHandle(req.Handle))
+
+	case *sshfxp.Read:
+		if req.Offset > math.MaxInt64 {
+			return statusResponse(os.ErrInvalid)
+		}
+
+		f, err := srv.fileHandle(req.Handle)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		length := int(req.Length)
+		if length > DefaultMaxReadLength {
+			length = DefaultMaxReadLength
+		}
+
+		buf := make([]byte, length)
+
+		n, err := f.ReadAt(buf, int64(req.Offset))
+		if n > 0 {
+			// errors, including io.EOF, are reported by the next request
+			return &sshfxp.Data{Data: string(buf[:n])}
+		}
+
+		if err == nil {
+			err = io.EOF
+		}
+
+		return statusResponse(err)
+
+	case *sshfxp.Write:
+		if req.Offset > math.MaxInt64-uint64(len(req.Data)) {
+			return statusResponse(os.ErrInvalid)
+		}
+
+		f, err := srv.fileHandle(req.Handle)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		_, err = f.WriteAt([]byte(req.Data), int64(req.Offset))
+
+		return statusResponse(err)
+
+	case *sshfxp.ReadDir:
+		d, err := srv.dirHandle(req.Handle)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		list, err := d.ReadDir(DefaultReadDirBatch)
+		if len(list) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+
+			return statusResponse(err)
+		}
+
+		names := &sshfxp.Name{}
+		for _, fi := range list {
+			names.Names = append(names.Names, sshfxp.NameInfo{
+				Filename: fi.Name(),
+				Longname: longName(fi),
+				Attr:     statAttr(fi),
+			})
+		}
+
+		return names
+
+	case *sshfxp.Stat:
+		return attrsResponse(h.Stat(req.Path))
+
+	case *sshfxp.LStat:
+		return attrsResponse(h.Lstat(req.Path))
+
+	case *sshfxp.FStat:
+		return attrsResponse(srv.statHandle(req.Handle))
+
+	case *sshfxp.SetStat:
+		attr, err := newFileAttr(req.Attr)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		return statusResponse(h.SetStat(req.Path, attr))
+
+	case *sshfxp.FSetStat:
+		attr, err := newFileAttr(req.Attr)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		return statusResponse(srv.setStatHandle(req.Handle, attr))
+
+	case *sshfxp.Remove:
+		return statusResponse(h.Remove(req.File))
+
+	case *sshfxp.Rename:
+		return statusResponse(h.Rename(req.OldPath, req.NewPath))
+
+	case *sshfxp.MkDir:
+		attr, err := newFileAttr(req.Attr)
+		if err != nil {
+			return statusResponse(err)
+		}
+
+		return statusResponse(h.Mkdir(req.Path, attr))
+
+	case *sshfxp.RmDir:
+		return statusResponse(h.Rmdir(req.Path))
+
+	case *sshfxp.RealPath:
+		return nameResponse(h.RealPath(req.Path))
+
+	case *sshfxp.ReadLink:
+		return nameResponse(h.ReadLink(req.Path))
+
+	case *sshfxp.Symlink:
+		// OpenSSH, and thus almost every client, sends the target of the
+		// link first
+		return statusResponse(h.Symlink(req.LinkPath, req.TargetPath))
+
+	case *sshfxp.Extended:
+		return srv.handleExtended(req)
+
+	default:
+		return &sshfxp.Status{
+			Error:   sshfxp.StatusOpUnsupported,
+			Message: fmt.Sprintf("unsupported request %T", msg),
+		}
+	}
+}
+
+// handleExtended dispatches req to the handler registered for the extension
+func (srv *Server) handleExtended(req *sshfxp.Extended) sshfxp.Message {
+	fn, ok := srv.extHandlers[req.Request]
+	if !ok {
+		return &sshfxp.Status{
+			Error:   sshfxp.StatusOpUnsupported,
+			Message: fmt.Sprintf("unsupported extension %q", req.Request),
+		}
+	}
+
+	payload, err := fn(srv, req)
+	if err != nil {
+		return statusResponse(err)
+	}
+
+	if payload == nil {
+		return statusResponse(nil)
+	}
+
+	reply := &sshfxp.ExtendedReply{}
+	if err := reply.SetPayload(payload); err != nil {
+		return statusResponse(err)
+	}
+
+	return reply
+}
+
+// isModifying returns true if msg modifies the file system
+func isModifying(msg sshfxp.Message) bool {
+	switch req := msg.(type) {
+	case *sshfxp.Open:
+		return req.PFlags&(sshfxp.OpenWrite|sshfxp.OpenAppend|sshfxp.OpenCreate|sshfxp.OpenTruncate) != 0
+	case *sshfxp.Write, *sshfxp.SetStat, *sshfxp.FSetStat, *sshfxp.Remove,
+		*sshfxp.Rename, *sshfxp.MkDir, *sshfxp.RmDir, *sshfxp.Symlink:
+		return true
+	default:
+		return false
+	}
+}
+
+// send encodes msg and queues it for being written to the client
+func (srv *Server) send(msg sshfxp.Message) error {
+	var pkt sshfxp.Packet
+
+	if err := pkt.Encode(msg); err != nil {
+		return err
+	}
+
+	select {
+	case srv.outgoing <- pkt:
+		return nil
+	case <-srv.done:
+		return errors.New("server closed")
+	}
+}
+
+// addHandle stores f in the handle table and returns its handle
+func (srv *Server) addHandle(f interface{}) string {
+	srv.handlesM.Lock()
+	defer srv.handlesM.Unlock()
+
+	srv.nextHandle++
+	handle := strconv.FormatUint(srv.nextHandle, 16)
+
+	srv.handles[handle] = f
+
+	return handle
+}
+
+// addDirHandle stores d, opened for path, in the handle table and returns
+// its handle
+func (srv *Server) addDirHandle(d DirHandle, path string) string {
+	handle := srv.addHandle(d)
+
+	srv.handlesM.Lock()
+	srv.dirPaths[handle] = path
+	srv.handlesM.Unlock()
+
+	return handle
+}
+
+func (srv *Server) getHandle(handle string) (interface{}, error) {
+	srv.handlesM.Lock()
+	defer srv.handlesM.Unlock()
+
+	f, ok := srv.handles[handle]
+	if !ok {
+		return nil, &sshfxp.FxpStatusError{
+			Code:    sshfxp.StatusFailure,
+			Message: "invalid handle",
+		}
+	}
+
+	return f, nil
+}
+
+func (srv *Server) fileHandle(handle string) (FileHandle, error) {
+	f, err := srv.getHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	fh, ok := f.(FileHandle)
+	if !ok {
+		return nil, &sshfxp.FxpStatusError{
+			Code:    sshfxp.StatusFailure,
+			Message: "not a file handle",
+		}
+	}
+
+	return fh, nil
+}
+
+func (srv *Server) dirHandle(handle string) (DirHandle, error) {
+	f, err := srv.getHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	dh, ok := f.(DirHandle)
+	if !ok {
+		return nil, &sshfxp.FxpStatusError{
+			Code:    sshfxp.StatusFailure,
+			Message: "not a directory handle",
+		}
+	}
+
+	return dh, nil
+}
+
+// statHandle returns the attributes of the file or directory opened as handle.
+// Directories not implementing DirStatHandle are looked up by path
+func (srv *Server) statHandle(handle string) (os.FileInfo, error) {
+	f, err := srv.getHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	switch h := f.(type) {
+	case FileHandle:
+		return h.Stat()
+	case DirStatHandle:
+		return h.Stat()
+	}
+
+	return srv.handler.Stat(srv.dirPath(handle))
+}
+
+// setStatHandle changes the attributes of the file or directory opened as
+// handle. Directories are changed by path
+func (srv *Server) setStatHandle(handle string, attr FileAttr) error {
+	f, err := srv.getHandle(handle)
+	if err != nil {
+		return err
+	}
+
+	if fh, ok := f.(FileHandle); ok {
+		return fh.SetStat(attr)
+	}
+
+	return srv.handler.SetStat(srv.dirPath(handle), attr)
+}
+
+// dirPath returns the path the directory handle has been opened for
+func (srv *Server) dirPath(handle string) string {
+	srv.handlesM.Lock()
+	defer srv.handlesM.Unlock()
+
+	return srv.dirPaths[handle]
+}
+
+// closeHandle removes handle from the handle table and closes it
+func (srv *Server) closeHandle(handle string) error {
+	srv.handlesM.Lock()
+	f, ok := srv.handles[handle]
+	delete(srv.handles, handle)
+	delete(srv.dirPaths, handle)
+	srv.handlesM.Unlock()
+
+	if !ok {
+		return &sshfxp.FxpStatusError{
+			Code:    sshfxp.StatusFailure,
+			Message: "invalid handle",
+		}
+	}
+
+	return f.(io.Closer).Close()
+}
+
+// closeHandles closes all handles left open by the client
+func (srv *Server) closeHandles() {
+	srv.handlesM.Lock()
+	handles := srv.handles
+	srv.handles = make(map[string]interface{})
+	srv.dirPaths = make(map[string]string)
+	srv.handlesM.Unlock()
+
+	for handle, f := range handles {
+		if err := f.(io.Closer).Close(); err != nil {
+			srv.log.Errorf("failed to close handle %q: %s", handle, err)
+		}
+	}
+}
+
+// statusResponse returns the SSH_FXP_STATUS response for err
+func statusResponse(err error) *sshfxp.Status {
+	status := &sshfxp.Status{
+		Error:   statusCode(err),
+		Message: "Success",
+	}
+
+	if err != nil {
+		status.Message = err.Error()
+	}
+
+	return status
+}
+
+// statusCode maps err to a SSH_FX_* status code
+func statusCode(err error) uint32 {
+	if err == nil {
+		return sshfxp.StatusOK
+	}
+
+	var statusErr *sshfxp.FxpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+
+	switch {
+	case err == io.EOF:
+		return sshfxp.StatusEOF
+	case errors.Is(err, ErrUnsupported):
+		return sshfxp.StatusOpUnsupported
+	case os.IsNotExist(err) || errors.Is(err, os.ErrNotExist):
+		return sshfxp.StatusNoSuchFile
+	case os.IsPermission(err) || errors.Is(err, os.ErrPermission):
+		return sshfxp.StatusPermissionDenied
+	default:
+		return sshfxp.StatusFailure
+	}
+}
+
+func attrsResponse(fi os.FileInfo, err error) sshfxp.Message {
+	if err != nil {
+		return statusResponse(err)
+	}
+
+	return &sshfxp.Attrs{Attr: statAttr(fi)}
+}
+
+func nameResponse(name string, err error) sshfxp.Message {
+	if err != nil {
+		return statusResponse(err)
+	}
+
+	return &sshfxp.Name{
+		Names: []sshfxp.NameInfo{
+			{Filename: name, Longname: name},
+		},
+	}
+}
@@ -0,0 +1,257 @@
+package sftp
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// recordingHandler records the Handler methods called by the server
+type recordingHandler struct {
+	*MemoryHandler
+
+	m     sync.Mutex
+	calls []string
+}
+
+func (h *recordingHandler) record(op string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.calls = append(h.calls, op)
+}
+
+func (h *recordingHandler) reset() []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	calls := h.calls
+	h.calls = nil
+	return calls
+}
+
+func (h *recordingHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	h.record("Open")
+	return h.MemoryHandler.Open(p, flag, attr)
+}
+
+func (h *recordingHandler) OpenDir(p string) (DirHandle, error) {
+	h.record("OpenDir")
+	return h.MemoryHandler.OpenDir(p)
+}
+
+func (h *recordingHandler) Stat(p string) (os.FileInfo, error) {
+	h.record("Stat")
+	return h.MemoryHandler.Stat(p)
+}
+
+func (h *recordingHandler) Lstat(p string) (os.FileInfo, error) {
+	h.record("Lstat")
+	return h.MemoryHandler.Lstat(p)
+}
+
+func (h *recordingHandler) SetStat(p string, attr FileAttr) error {
+	h.record("SetStat")
+	return h.MemoryHandler.SetStat(p, attr)
+}
+
+func (h *recordingHandler) Remove(p string) error {
+	h.record("Remove")
+	return h.MemoryHandler.Remove(p)
+}
+
+func (h *recordingHandler) Rename(oldpath, newpath string) error {
+	h.record("Rename")
+	return h.MemoryHandler.Rename(oldpath, newpath)
+}
+
+func (h *recordingHandler) Mkdir(p string, attr FileAttr) error {
+	h.record("Mkdir")
+	return h.MemoryHandler.Mkdir(p, attr)
+}
+
+func (h *recordingHandler) Rmdir(p string) error {
+	h.record("Rmdir")
+	return h.MemoryHandler.Rmdir(p)
+}
+
+func (h *recordingHandler) RealPath(p string) (string, error) {
+	h.record("RealPath")
+	return h.MemoryHandler.RealPath(p)
+}
+
+func (h *recordingHandler) ReadLink(p string) (string, error) {
+	h.record("ReadLink")
+	return h.MemoryHandler.ReadLink(p)
+}
+
+func (h *recordingHandler) Symlink(target, linkpath string) error {
+	h.record("Symlink")
+	return h.MemoryHandler.Symlink(target, linkpath)
+}
+
+// newServerClient connects a Client to a Server serving handler
+func newServerClient(t *testing.T, handler Handler, opts ...ServerOption) *Client {
+	t.Helper()
+
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+
+	srv, err := NewServer(serverReader, serverWriter, handler, opts...)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+
+	go func() {
+		srv.Serve()
+		serverWriter.Close()
+	}()
+
+	cli, err := NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatalf("NewClientPipe: %s", err)
+	}
+
+	t.Cleanup(func() { cli.Close() })
+
+	return cli
+}
+
+func TestServerDispatch(t *testing.T) {
+	h := &recordingHandler{MemoryHandler: NewMemoryHandler()}
+	cli := newServerClient(t, h)
+
+	steps := []struct {
+		name  string
+		fn    func() error
+		calls []string
+	}{
+		{"mkdir", func() error { return cli.MkDir("/dir", nil) }, []string{"Mkdir"}},
+		{"create", func() error {
+			f, err := cli.OpenFile("/dir/file", os.O_WRONLY|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}, []string{"Open"}},
+		{"stat", func() error { _, err := cli.Stat("/dir/file"); return err }, []string{"Stat"}},
+		{"lstat", func() error { _, err := cli.Lstat("/dir/file"); return err }, []string{"Lstat"}},
+		{"chmod", func() error { return cli.Chmod("/dir/file", 0600) }, []string{"SetStat"}},
+		{"list", func() error { _, err := cli.List("/dir"); return err }, []string{"OpenDir"}},
+		{"symlink", func() error { return cli.Symlink("/dir/file", "/link") }, []string{"Symlink"}},
+		{"readlink", func() error { _, err := cli.ReadLink("/link"); return err }, []string{"ReadLink"}},
+		{"realpath", func() error { _, err := cli.RealPath("/dir/../dir"); return err }, []string{"RealPath"}},
+		{"rename", func() error { return cli.Rename("/dir/file", "/dir/moved") }, []string{"Rename"}},
+		{"remove", func() error { return cli.Remove("/dir/moved") }, []string{"Remove"}},
+		{"rmdir", func() error { return cli.RmDir("/dir") }, []string{"Rmdir"}},
+	}
+
+	for _, step := range steps {
+		if err := step.fn(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+
+		if calls := h.reset(); !reflect.DeepEqual(calls, step.calls) {
+			t.Errorf("%s: handler received %v, expected %v", step.name, calls, step.calls)
+		}
+	}
+}
+
+func TestServerInvalidHandle(t *testing.T) {
+	cli := newServerClient(t, NewMemoryHandler())
+
+	if _, err := cli.Read("no-such-handle", 0, 10); err == nil {
+		t.Error("Read with an unknown handle succeeded")
+	}
+
+	if err := cli.CloseHandle("no-such-handle"); err == nil {
+		t.Error("closing an unknown handle succeeded")
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	h := &recordingHandler{MemoryHandler: NewMemoryHandler()}
+
+	f, err := h.MemoryHandler.Open("/file", os.O_WRONLY|os.O_CREATE, FileAttr{})
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	f.WriteAt([]byte("data"), 0)
+	f.Close()
+
+	cli := newServerClient(t, h, ReadOnly())
+
+	denied := map[string]func() error{
+		"write": func() error {
+			_, err := cli.OpenFile("/file", os.O_WRONLY, 0)
+			return err
+		},
+		"create": func() error {
+			_, err := cli.OpenFile("/new", os.O_RDONLY|os.O_CREATE, 0644)
+			return err
+		},
+		"setstat":      func() error { return cli.Chmod("/file", 0600) },
+		"remove":       func() error { return cli.Remove("/file") },
+		"rename":       func() error { return cli.Rename("/file", "/moved") },
+		"posix-rename": func() error { return cli.PosixRename("/file", "/moved") },
+		"mkdir":        func() error { return cli.MkDir("/dir", nil) },
+		"rmdir":        func() error { return cli.RmDir("/file") },
+		"symlink":      func() error { return cli.Symlink("/file", "/link") },
+	}
+
+	for name, fn := range denied {
+		err := fn()
+		if code, _ := statusCodeOf(err); code != sshfxp.StatusPermissionDenied {
+			t.Errorf("%s returned %v, expected SSH_FX_PERMISSION_DENIED", name, err)
+		}
+	}
+
+	if calls := h.reset(); len(calls) != 0 {
+		t.Errorf("modifying requests reached the handler: %v", calls)
+	}
+
+	file, err := cli.OpenFile("/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile for reading: %s", err)
+	}
+	defer file.Close()
+
+	if code, _ := statusCodeOf(cli.Fchmod(file.Handle(), 0600)); code != sshfxp.StatusPermissionDenied {
+		t.Error("fsetstat on a read-only server was not denied")
+	}
+
+	if _, err := cli.Stat("/file"); err != nil {
+		t.Errorf("Stat on a read-only server: %s", err)
+	}
+}
+
+func TestServerDirHandleStat(t *testing.T) {
+	cli := newServerClient(t, NewMemoryHandler())
+
+	if err := cli.MkDir("/dir", nil); err != nil {
+		t.Fatalf("MkDir: %s", err)
+	}
+
+	handle, err := cli.OpenDir("/dir")
+	if err != nil {
+		t.Fatalf("OpenDir: %s", err)
+	}
+	defer cli.CloseHandle(handle)
+
+	if err := cli.Fchmod(handle, 0700); err != nil {
+		t.Fatalf("Fchmod of a directory handle: %s", err)
+	}
+
+	fi, err := cli.Fstat(handle)
+	if err != nil {
+		t.Fatalf("Fstat of a directory handle: %s", err)
+	}
+
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Errorf("Fstat returned mode %s, expected a directory with permissions 0700", fi.Mode())
+	}
+}
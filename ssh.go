@@ -0,0 +1,138 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Dial connects to the SSH server at addr, authenticates using config and
+// starts a SFTP session. Closing the returned client also closes the SSH
+// connection
+func Dial(network, addr string, config *ssh.ClientConfig, opts ...ClientOption) (*Client, error) {
+	conn, err := ssh.Dial(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := newClientFromSSH(conn, conn, "", opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return cli, nil
+}
+
+// NewClientFromSSH starts the "sftp" subsystem on a new session of conn and
+// returns a client using it. Closing the client closes the session but leaves
+// conn open
+func NewClientFromSSH(conn *ssh.Client, opts ...ClientOption) (*Client, error) {
+	return newClientFromSSH(conn, nil, "", opts)
+}
+
+// NewClientFromSSHCommand runs cmd on the remote host instead of requesting
+// the "sftp" subsystem and speaks SFTP over its standard input and output.
+// This is useful for servers that do not register the subsystem or to start a
+// different SFTP server binary (e.g. "sudo /usr/lib/openssh/sftp-server").
+// Closing the client closes the session but leaves conn open
+func NewClientFromSSHCommand(conn *ssh.Client, cmd string, opts ...ClientOption) (*Client, error) {
+	return newClientFromSSH(conn, nil, cmd, opts)
+}
+
+// newClientFromSSH opens a new session on conn and starts either the SFTP
+// subsystem or cmd. If owned is not nil it is closed together with the session
+func newClientFromSSH(conn *ssh.Client, owned io.Closer, cmd string, opts []ClientOption) (*Client, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session: %s", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if cmd == "" {
+		err = session.RequestSubsystem("sftp")
+	} else {
+		err = session.Start(cmd)
+	}
+
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start SFTP server: %s", err)
+	}
+
+	sc := &sessionCloser{
+		session: session,
+		owned:   owned,
+	}
+
+	return NewClientPipe(&sessionReader{stdout, sc}, &sessionWriter{stdin, sc}, opts...)
+}
+
+// sessionCloser closes an SSH session and, if set, the connection owning it
+// exactly once
+type sessionCloser struct {
+	session *ssh.Session
+	owned   io.Closer
+
+	once sync.Once
+	err  error
+}
+
+func (sc *sessionCloser) Close() error {
+	sc.once.Do(func() {
+		sc.err = sc.session.Close()
+
+		if sc.owned != nil {
+			if err := sc.owned.Close(); sc.err == nil {
+				sc.err = err
+			}
+		}
+	})
+
+	// closing a session that has already been terminated by the remote side
+	// is not an error worth reporting
+	if sc.err == io.EOF {
+		return nil
+	}
+
+	return sc.err
+}
+
+// sessionReader is the read side of a SFTP session. Closing it tears down the
+// whole session
+type sessionReader struct {
+	io.Reader
+
+	sc *sessionCloser
+}
+
+func (sr *sessionReader) Close() error {
+	return sr.sc.Close()
+}
+
+// sessionWriter is the write side of a SFTP session. Closing it signals EOF to
+// the server before tearing down the session
+type sessionWriter struct {
+	io.WriteCloser
+
+	sc *sessionCloser
+}
+
+func (sw *sessionWriter) Close() error {
+	sw.WriteCloser.Close()
+
+	return sw.sc.Close()
+}
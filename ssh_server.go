@@ -0,0 +1,315 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrSSHServerClosed is returned by SSHServer.Serve and ListenAndServe after
+// the server has been closed
+var ErrSSHServerClosed = errors.New("sftp: ssh server closed")
+
+// DefaultSSHHandshakeTimeout is the time a client has to complete the SSH
+// handshake including authentication
+var DefaultSSHHandshakeTimeout = 30 * time.Second
+
+// HandlerFactory returns the Handler serving a SFTP session of an
+// authenticated user. perms holds the permissions returned by the
+// authentication callback of the ssh.ServerConfig. If the Handler implements
+// io.Closer, it is closed once the session ends
+type HandlerFactory func(conn ssh.ConnMetadata, perms *ssh.Permissions) (Handler, error)
+
+// SSHServer is a SSH server that only provides the "sftp" subsystem. Clients
+// are authenticated using the callbacks of the ssh.ServerConfig, e.g.
+// PasswordCallback and PublicKeyCallback, and each SFTP session is served by
+// the Handler returned by the HandlerFactory for the user
+type SSHServer struct {
+	config  *ssh.ServerConfig
+	factory HandlerFactory
+	opts    []ServerOption
+	log     logrus.FieldLogger
+
+	m         sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// NewSSHServer creates a new SSH server. config must hold at least one host
+// key and the authentication callbacks. opts are applied to every SFTP
+// session
+func NewSSHServer(config *ssh.ServerConfig, factory HandlerFactory, opts ...ServerOption) (*SSHServer, error) {
+	if config == nil {
+		return nil, errors.New("ssh config must not be nil")
+	}
+
+	if factory == nil {
+		return nil, errors.New("handler factory must not be nil")
+	}
+
+	// apply the options once to report errors early and to learn about the
+	// logger
+	probe := &Server{log: logrus.StandardLogger()}
+	for _, opt := range opts {
+		if err := opt(probe); err != nil {
+			return nil, fmt.Errorf("invalid option: %s", err)
+		}
+	}
+
+	return &SSHServer{
+		config:    config,
+		factory:   factory,
+		opts:      opts,
+		log:       probe.log,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// ListenAndServe listens on the TCP address addr and serves incoming
+// connections. It always returns a non-nil error
+func (s *SSHServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine.
+// l is closed when Serve returns. Temporary failures to accept a connection
+// are retried with increasing delays of up to one second, all others stop
+// Serve. Serve always returns a non-nil error, ErrSSHServerClosed after Close
+// has been called
+func (s *SSHServer) Serve(l net.Listener) error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		l.Close()
+		return ErrSSHServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.m.Unlock()
+
+	defer func() {
+		s.m.Lock()
+		delete(s.listeners, l)
+		s.m.Unlock()
+
+		l.Close()
+	}()
+
+	var delay time.Duration
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrSSHServerClosed
+			}
+
+			if !isTemporary(err) {
+				return err
+			}
+
+			// back off like net/http so running out of file descriptors
+			// does not cause a busy loop
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+
+			if delay > time.Second {
+				delay = time.Second
+			}
+
+			s.log.Warnf("failed to accept connection: %s, retrying in %s", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops all listeners and closes all connections
+func (s *SSHServer) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.closed = true
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (s *SSHServer) isClosed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.closed
+}
+
+// track adds conn to the set of active connections. It returns false if the
+// server has been closed
+func (s *SSHServer) track(conn net.Conn) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *SSHServer) untrack(conn net.Conn) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.conns, conn)
+}
+
+func (s *SSHServer) serveConn(conn net.Conn) {
+	if !s.track(conn) {
+		conn.Close()
+		return
+	}
+
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	log := s.log.WithField("remote", conn.RemoteAddr().String())
+
+	conn.SetDeadline(time.Now().Add(DefaultSSHHandshakeTimeout))
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Debugf("SSH handshake failed: %s", err)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	log = log.WithField("user", sconn.User())
+	log.Infof("user authenticated")
+
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			log.Errorf("failed to accept session: %s", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveSession(sconn, ch, requests, log)
+		}()
+	}
+
+	wg.Wait()
+
+	log.Infof("connection closed")
+}
+
+// serveSession waits for a "sftp" subsystem request on ch and serves it
+func (s *SSHServer) serveSession(sconn *ssh.ServerConn, ch ssh.Channel, requests <-chan *ssh.Request, log logrus.FieldLogger) {
+	defer ch.Close()
+
+	for req := range requests {
+		if req.Type != "subsystem" || !isSFTPSubsystem(req.Payload) {
+			log.Debugf("rejecting %q request", req.Type)
+			req.Reply(false, nil)
+			continue
+		}
+
+		handler, err := s.factory(sconn, sconn.Permissions)
+		if err != nil {
+			log.Errorf("failed to create handler: %s", err)
+			req.Reply(false, nil)
+			return
+		}
+
+		if closer, ok := handler.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		opts := append(s.opts[:len(s.opts):len(s.opts)], WithServerLogger(log))
+
+		srv, err := NewServer(struct{ io.Reader }{ch}, ch, handler, opts...)
+		if err != nil {
+			log.Errorf("failed to create SFTP server: %s", err)
+			req.Reply(false, nil)
+			return
+		}
+
+		req.Reply(true, nil)
+
+		// the remaining requests of the session are not of interest
+		go func() {
+			for req := range requests {
+				req.Reply(false, nil)
+			}
+		}()
+
+		var status uint32
+		if err := srv.Serve(); err != nil {
+			log.Errorf("SFTP session failed: %s", err)
+			status = 1
+		}
+
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+
+		return
+	}
+}
+
+// isSFTPSubsystem returns true if payload of a "subsystem" request names the
+// "sftp" subsystem
+func isSFTPSubsystem(payload []byte) bool {
+	var msg struct{ Name string }
+
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return false
+	}
+
+	return msg.Name == "sftp"
+}
+
+// isTemporary returns true if the accept error err is worth retrying. Like
+// net/http this relies on Temporary, which is true for running out of file
+// descriptors (EMFILE, ENFILE) and aborted connections
+func isTemporary(err error) bool {
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
@@ -0,0 +1,197 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testPassword = "secret"
+
+// startSSHServer serves a MemoryHandler per user on a random local port. It
+// returns the server, a function dialing it and a channel receiving the
+// result of Serve
+func startSSHServer(t *testing.T) (*SSHServer, func(user, password string) (*Client, error), <-chan error) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != testPassword {
+				return nil, errors.New("wrong password")
+			}
+
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	var handlersM sync.Mutex
+	handlers := make(map[string]Handler)
+
+	srv, err := NewSSHServer(config, func(conn ssh.ConnMetadata, perms *ssh.Permissions) (Handler, error) {
+		handlersM.Lock()
+		defer handlersM.Unlock()
+
+		h, ok := handlers[conn.User()]
+		if !ok {
+			h = NewMemoryHandler()
+			handlers[conn.User()] = h
+		}
+
+		return h, nil
+	})
+	if err != nil {
+		t.Fatalf("NewSSHServer: %s", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(l)
+	}()
+
+	t.Cleanup(func() { srv.Close() })
+
+	dial := func(user, password string) (*Client, error) {
+		return Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	return srv, dial, done
+}
+
+func TestSSHServer(t *testing.T) {
+	srv, dial, done := startSSHServer(t)
+
+	if cli, err := dial("alice", "wrong"); err == nil {
+		cli.Close()
+		t.Fatal("authenticated with a wrong password")
+	}
+
+	alice, err := dial("alice", testPassword)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer alice.Close()
+
+	bob, err := dial("bob", testPassword)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer bob.Close()
+
+	if err := alice.MkDir("/alice", nil); err != nil {
+		t.Fatalf("MkDir: %s", err)
+	}
+
+	if list, err := alice.List("/"); err != nil || len(list) != 1 {
+		t.Errorf("alice sees %d entries, %v", len(list), err)
+	}
+
+	if list, err := bob.List("/"); err != nil || len(list) != 0 {
+		t.Errorf("bob sees %d entries of alice, %v", len(list), err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != ErrSSHServerClosed {
+			t.Errorf("Serve returned %v, expected ErrSSHServerClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+
+	select {
+	case <-bob.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client connection survived Close")
+	}
+}
+
+// failingListener fails the first failures calls of Accept with err and
+// reports a closed listener afterwards
+type failingListener struct {
+	net.Listener
+
+	err      error
+	failures int
+	accepts  int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if l.accepts <= l.failures {
+		return nil, l.err
+	}
+
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error {
+	return nil
+}
+
+func TestSSHServerAcceptErrors(t *testing.T) {
+	srv, err := NewSSHServer(&ssh.ServerConfig{}, func(conn ssh.ConnMetadata, perms *ssh.Permissions) (Handler, error) {
+		return NewMemoryHandler(), nil
+	})
+	if err != nil {
+		t.Fatalf("NewSSHServer: %s", err)
+	}
+
+	temporary := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	permanent := errors.New("listener broken")
+
+	tests := []struct {
+		name     string
+		err      error
+		accepts  int
+		expected error
+	}{
+		{"temporary", temporary, 4, net.ErrClosed},
+		{"permanent", permanent, 1, permanent},
+	}
+
+	for _, test := range tests {
+		l := &failingListener{err: test.err, failures: 3}
+
+		err := srv.Serve(l)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: Serve returned %v, expected %v", test.name, err, test.expected)
+		}
+
+		if l.accepts != test.accepts {
+			t.Errorf("%s: Serve called Accept %d times, expected %d", test.name, l.accepts, test.accepts)
+		}
+	}
+}
@@ -23,3 +23,12 @@ func IsError(x interface{}) error {
 
 	return nil
 }
+
+// IsEOF returns true if err is a status error carrying StatusEOF
+func IsEOF(err error) bool {
+	if e, ok := err.(*FxpStatusError); ok && e.Code == StatusEOF {
+		return true
+	}
+
+	return false
+}
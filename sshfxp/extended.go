@@ -0,0 +1,188 @@
+package sshfxp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Extended represents a SSH_FXP_EXTENDED request. Request holds the name of
+// the extension, Data the request specific payload
+type Extended struct {
+	ID uint32
+
+	Request string
+	Data    []byte
+}
+
+func (x *Extended) SetID(id uint32) {
+	x.ID = id
+}
+
+func (x *Extended) GetID() uint32 {
+	return x.ID
+}
+
+func (x *Extended) Write(w io.Writer) error {
+	if err := writeString(w, x.Request); err != nil {
+		return err
+	}
+
+	_, err := w.Write(x.Data)
+	return err
+}
+
+func (x *Extended) Read(r io.Reader) error {
+	if err := readString(r, &x.Request); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	x.Data = data
+	return nil
+}
+
+// SetPayload encodes payload into Data. A nil payload results in empty data
+func (x *Extended) SetPayload(payload Writer) error {
+	data, err := encodePayload(payload)
+	if err != nil {
+		return err
+	}
+
+	x.Data = data
+	return nil
+}
+
+// Payload decodes Data using the request type registered for the extension
+// named by Request
+func (x *Extended) Payload() (Message, error) {
+	ext, ok := lookupExtension(x.Request)
+	if !ok || ext.request == nil {
+		return nil, fmt.Errorf("unknown extension %q", x.Request)
+	}
+
+	return decodePayload(ext.request(), x.Data)
+}
+
+// ExtendedReply represents a SSH_FXP_EXTENDED_REPLY response. Data holds the
+// extension specific payload
+type ExtendedReply struct {
+	ID uint32
+
+	Data []byte
+}
+
+func (x *ExtendedReply) SetID(id uint32) {
+	x.ID = id
+}
+
+func (x *ExtendedReply) GetID() uint32 {
+	return x.ID
+}
+
+func (x *ExtendedReply) Write(w io.Writer) error {
+	_, err := w.Write(x.Data)
+	return err
+}
+
+func (x *ExtendedReply) Read(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	x.Data = data
+	return nil
+}
+
+// SetPayload encodes payload into Data. A nil payload results in empty data
+func (x *ExtendedReply) SetPayload(payload Writer) error {
+	data, err := encodePayload(payload)
+	if err != nil {
+		return err
+	}
+
+	x.Data = data
+	return nil
+}
+
+// Payload decodes Data using the reply type registered for the extension
+// named request
+func (x *ExtendedReply) Payload(request string) (Message, error) {
+	ext, ok := lookupExtension(request)
+	if !ok || ext.reply == nil {
+		return nil, fmt.Errorf("unknown reply for extension %q", request)
+	}
+
+	return decodePayload(ext.reply(), x.Data)
+}
+
+type extension struct {
+	request func() Message
+	reply   func() Message
+}
+
+var (
+	extensionsM sync.RWMutex
+	extensions  = make(map[string]extension)
+)
+
+// RegisterExtension registers the payload types of the extension name.
+// request and reply return new, empty payloads for SSH_FXP_EXTENDED and
+// SSH_FXP_EXTENDED_REPLY packets. request may be nil for requests without
+// payload, reply for extensions that are answered with SSH_FXP_STATUS
+func RegisterExtension(name string, request, reply func() Message) {
+	extensionsM.Lock()
+	defer extensionsM.Unlock()
+
+	extensions[name] = extension{request, reply}
+}
+
+// IsRegisteredExtension returns true if payload types for the extension name
+// have been registered
+func IsRegisteredExtension(name string) bool {
+	_, ok := lookupExtension(name)
+	return ok
+}
+
+// HasExtendedReply returns true if the extension name has been registered
+// with a reply payload
+func HasExtendedReply(name string) bool {
+	ext, ok := lookupExtension(name)
+	return ok && ext.reply != nil
+}
+
+func lookupExtension(name string) (extension, bool) {
+	extensionsM.RLock()
+	defer extensionsM.RUnlock()
+
+	ext, ok := extensions[name]
+	return ext, ok
+}
+
+func encodePayload(payload Writer) ([]byte, error) {
+	if payload == nil {
+		return nil, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := payload.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodePayload(msg Message, data []byte) (Message, error) {
+	if err := msg.Read(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to read payload: %s", err)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,151 @@
+package sshfxp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtendedPackets(t *testing.T) {
+	tests := []Message{
+		&Extended{ID: 1, Request: "foo@example.com", Data: []byte("data")},
+		&Extended{ID: 2, Request: "foo@example.com"},
+		&ExtendedReply{ID: 3, Data: []byte("data")},
+		&ExtendedReply{ID: 4},
+	}
+
+	for _, x := range tests {
+		msg := roundTrip(t, x)
+
+		// empty data is decoded as an empty slice
+		switch m := msg.(type) {
+		case *Extended:
+			if len(m.Data) == 0 {
+				m.Data = nil
+			}
+		case *ExtendedReply:
+			if len(m.Data) == 0 {
+				m.Data = nil
+			}
+		}
+
+		if !reflect.DeepEqual(msg, x) {
+			t.Errorf("decoded %#v, expected %#v", msg, x)
+		}
+	}
+}
+
+func TestExtensionPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		request Writer
+		reply   Writer
+	}{
+		{ExtPosixRename, &PosixRename{OldPath: "/a", NewPath: "/b"}, nil},
+		{ExtHardlink, &Hardlink{OldPath: "/a", NewPath: "/b"}, nil},
+		{ExtFSync, &FSync{Handle: "handle"}, nil},
+		{ExtStatVFS, &StatVFSPath{Path: "/a"}, &StatVFS{
+			BlockSize: 4096, FragmentSize: 1024, Blocks: 1000, BlocksFree: 500, BlocksAvail: 400,
+			Files: 100, FilesFree: 50, FilesAvail: 40, FSID: 7, Flag: StatVFSReadOnly | StatVFSNoSUID, NameMax: 255,
+		}},
+		{ExtFStatVFS, &StatVFSHandle{Handle: "handle"}, &StatVFS{BlockSize: 512, NameMax: 255}},
+		{ExtLimits, nil, &Limits{MaxPacketLength: 262144, MaxReadLength: 261120, MaxWriteLength: 261120, MaxOpenHandles: 1024}},
+		{ExtCopyData, &CopyData{ReadHandle: "src", ReadOffset: 10, Length: 100, WriteHandle: "dst", WriteOffset: 20}, nil},
+		{ExtCopyFile, &CopyFile{Source: "/a", Destination: "/b", Overwrite: true}, nil},
+	}
+
+	for _, test := range tests {
+		if !IsRegisteredExtension(test.name) {
+			t.Errorf("%s is not registered", test.name)
+			continue
+		}
+
+		if hasReply := HasExtendedReply(test.name); hasReply != (test.reply != nil) {
+			t.Errorf("%s: HasExtendedReply returned %t", test.name, hasReply)
+		}
+
+		req := &Extended{ID: 1, Request: test.name}
+		if err := req.SetPayload(test.request); err != nil {
+			t.Fatalf("%s: SetPayload: %s", test.name, err)
+		}
+
+		if test.request != nil {
+			payload, err := roundTrip(t, req).(*Extended).Payload()
+			if err != nil {
+				t.Errorf("%s: request payload: %s", test.name, err)
+			} else if !reflect.DeepEqual(payload, test.request) {
+				t.Errorf("%s: decoded request %#v, expected %#v", test.name, payload, test.request)
+			}
+		} else if len(req.Data) != 0 {
+			t.Errorf("%s: nil payload encoded as %v", test.name, req.Data)
+		}
+
+		if test.reply == nil {
+			continue
+		}
+
+		reply := &ExtendedReply{ID: 1}
+		if err := reply.SetPayload(test.reply); err != nil {
+			t.Fatalf("%s: SetPayload: %s", test.name, err)
+		}
+
+		payload, err := roundTrip(t, reply).(*ExtendedReply).Payload(test.name)
+		if err != nil {
+			t.Errorf("%s: reply payload: %s", test.name, err)
+		} else if !reflect.DeepEqual(payload, test.reply) {
+			t.Errorf("%s: decoded reply %#v, expected %#v", test.name, payload, test.reply)
+		}
+	}
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	const name = "registry-test@example.com"
+
+	if IsRegisteredExtension(name) {
+		t.Fatalf("%s is registered before RegisterExtension", name)
+	}
+
+	req := &Extended{Request: name, Data: []byte{0, 0, 0, 1, 'a'}}
+	if _, err := req.Payload(); err == nil {
+		t.Error("decoded the payload of an unregistered extension")
+	}
+
+	if _, err := (&ExtendedReply{}).Payload(name); err == nil {
+		t.Error("decoded the reply of an unregistered extension")
+	}
+
+	RegisterExtension(name, func() Message { return &FSync{} }, nil)
+
+	payload, err := req.Payload()
+	if err != nil {
+		t.Fatalf("Payload: %s", err)
+	}
+
+	if fsync, ok := payload.(*FSync); !ok || fsync.Handle != "a" {
+		t.Errorf("Payload returned %#v", payload)
+	}
+
+	if HasExtendedReply(name) {
+		t.Error("HasExtendedReply reported a reply for a request without reply type")
+	}
+
+	if _, err := (&ExtendedReply{}).Payload(name); err == nil {
+		t.Error("decoded a reply without reply type")
+	}
+
+	// payloads must not exceed the data
+	req.Data = []byte{0, 0, 0, 5, 'a'}
+	if _, err := req.Payload(); err == nil {
+		t.Error("decoded a truncated payload")
+	}
+}
+
+func TestUnknownMessage(t *testing.T) {
+	if id := TypeID(42); id != 0 {
+		t.Errorf("TypeID of an unknown message returned %d", id)
+	}
+
+	var pkt Packet
+	if err := pkt.Encode(&PosixRename{}); err == nil {
+		t.Error("encoded an extension payload as packet")
+	}
+}
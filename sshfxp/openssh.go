@@ -0,0 +1,246 @@
+package sshfxp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Names of the protocol extensions introduced by OpenSSH and of the copy
+// extensions from draft-ietf-secsh-filexfer-extensions
+const (
+	ExtPosixRename = "posix-rename@openssh.com"
+	ExtStatVFS     = "statvfs@openssh.com"
+	ExtFStatVFS    = "fstatvfs@openssh.com"
+	ExtHardlink    = "hardlink@openssh.com"
+	ExtFSync       = "fsync@openssh.com"
+	ExtLimits      = "limits@openssh.com"
+	ExtCopyData    = "copy-data"
+	ExtCopyFile    = "copy-file"
+)
+
+func init() {
+	RegisterExtension(ExtPosixRename, func() Message { return &PosixRename{} }, nil)
+	RegisterExtension(ExtStatVFS, func() Message { return &StatVFSPath{} }, func() Message { return &StatVFS{} })
+	RegisterExtension(ExtFStatVFS, func() Message { return &StatVFSHandle{} }, func() Message { return &StatVFS{} })
+	RegisterExtension(ExtHardlink, func() Message { return &Hardlink{} }, nil)
+	RegisterExtension(ExtFSync, func() Message { return &FSync{} }, nil)
+	RegisterExtension(ExtLimits, nil, func() Message { return &Limits{} })
+	RegisterExtension(ExtCopyData, func() Message { return &CopyData{} }, nil)
+	RegisterExtension(ExtCopyFile, func() Message { return &CopyFile{} }, nil)
+}
+
+// PosixRename is the payload of a posix-rename@openssh.com request. Unlike
+// SSH_FXP_RENAME it replaces an existing NewPath
+type PosixRename struct {
+	OldPath string
+	NewPath string
+}
+
+func (x *PosixRename) Write(w io.Writer) error {
+	if err := writeString(w, x.OldPath); err != nil {
+		return err
+	}
+
+	return writeString(w, x.NewPath)
+}
+
+func (x *PosixRename) Read(r io.Reader) error {
+	if err := readString(r, &x.OldPath); err != nil {
+		return err
+	}
+
+	return readString(r, &x.NewPath)
+}
+
+// Hardlink is the payload of a hardlink@openssh.com request creating NewPath
+// as a hard link to OldPath
+type Hardlink struct {
+	OldPath string
+	NewPath string
+}
+
+func (x *Hardlink) Write(w io.Writer) error {
+	if err := writeString(w, x.OldPath); err != nil {
+		return err
+	}
+
+	return writeString(w, x.NewPath)
+}
+
+func (x *Hardlink) Read(r io.Reader) error {
+	if err := readString(r, &x.OldPath); err != nil {
+		return err
+	}
+
+	return readString(r, &x.NewPath)
+}
+
+// FSync is the payload of a fsync@openssh.com request
+type FSync struct {
+	Handle string
+}
+
+func (x *FSync) Write(w io.Writer) error {
+	return writeString(w, x.Handle)
+}
+
+func (x *FSync) Read(r io.Reader) error {
+	return readString(r, &x.Handle)
+}
+
+// StatVFSPath is the payload of a statvfs@openssh.com request
+type StatVFSPath struct {
+	Path string
+}
+
+func (x *StatVFSPath) Write(w io.Writer) error {
+	return writeString(w, x.Path)
+}
+
+func (x *StatVFSPath) Read(r io.Reader) error {
+	return readString(r, &x.Path)
+}
+
+// StatVFSHandle is the payload of a fstatvfs@openssh.com request
+type StatVFSHandle struct {
+	Handle string
+}
+
+func (x *StatVFSHandle) Write(w io.Writer) error {
+	return writeString(w, x.Handle)
+}
+
+func (x *StatVFSHandle) Read(r io.Reader) error {
+	return readString(r, &x.Handle)
+}
+
+// Flags reported in StatVFS.Flag
+const (
+	StatVFSReadOnly = 0x1
+	StatVFSNoSUID   = 0x2
+)
+
+// StatVFS is the reply payload of statvfs@openssh.com and
+// fstatvfs@openssh.com requests. It mirrors struct statvfs of POSIX
+type StatVFS struct {
+	BlockSize    uint64 // file system block size
+	FragmentSize uint64 // fundamental block size, the unit of the block counts
+	Blocks       uint64 // number of blocks
+	BlocksFree   uint64 // free blocks
+	BlocksAvail  uint64 // free blocks available to unprivileged users
+	Files        uint64 // number of inodes
+	FilesFree    uint64 // free inodes
+	FilesAvail   uint64 // free inodes available to unprivileged users
+	FSID         uint64 // file system ID
+	Flag         uint64 // StatVFSReadOnly and StatVFSNoSUID
+	NameMax      uint64 // maximum length of file names
+}
+
+func (x *StatVFS) Write(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, x)
+}
+
+func (x *StatVFS) Read(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, x)
+}
+
+// Limits is the reply payload of a limits@openssh.com request. The request
+// does not carry a payload. Zero values mean the server does not enforce a
+// specific limit
+type Limits struct {
+	MaxPacketLength uint64 // maximum length of a packet the server accepts
+	MaxReadLength   uint64 // maximum data length of a SSH_FXP_READ
+	MaxWriteLength  uint64 // maximum data length of a SSH_FXP_WRITE
+	MaxOpenHandles  uint64 // maximum number of open handles
+}
+
+func (x *Limits) Write(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, x)
+}
+
+func (x *Limits) Read(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, x)
+}
+
+// CopyData is the payload of a copy-data request. Length bytes are copied
+// from ReadHandle at ReadOffset to WriteHandle at WriteOffset. A zero Length
+// copies until the end of the file
+type CopyData struct {
+	ReadHandle  string
+	ReadOffset  uint64
+	Length      uint64
+	WriteHandle string
+	WriteOffset uint64
+}
+
+func (x *CopyData) Write(w io.Writer) error {
+	if err := writeString(w, x.ReadHandle); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, x.ReadOffset); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, x.Length); err != nil {
+		return err
+	}
+
+	if err := writeString(w, x.WriteHandle); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, x.WriteOffset)
+}
+
+func (x *CopyData) Read(r io.Reader) error {
+	if err := readString(r, &x.ReadHandle); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &x.ReadOffset); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &x.Length); err != nil {
+		return err
+	}
+
+	if err := readString(r, &x.WriteHandle); err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, &x.WriteOffset)
+}
+
+// CopyFile is the payload of a copy-file request copying Source to
+// Destination. An existing Destination is only replaced if Overwrite is set
+type CopyFile struct {
+	Source      string
+	Destination string
+	Overwrite   bool
+}
+
+func (x *CopyFile) Write(w io.Writer) error {
+	if err := writeString(w, x.Source); err != nil {
+		return err
+	}
+
+	if err := writeString(w, x.Destination); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, x.Overwrite)
+}
+
+func (x *CopyFile) Read(r io.Reader) error {
+	if err := readString(r, &x.Source); err != nil {
+		return err
+	}
+
+	if err := readString(r, &x.Destination); err != nil {
+		return err
+	}
+
+	return binary.Read(r, binary.BigEndian, &x.Overwrite)
+}
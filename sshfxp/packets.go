@@ -9,33 +9,33 @@ import (
 
 // SSH_FXP defines the following packet types
 const (
-	TypeInit          = 1 // [X]
-	TypeVersion       = 2 // [X]
-	TypeOpen          = 3 // [X]
-	TypeClose         = 4 // [X]
-	TypeRead          = 5 // [X]
-	TypeWrite         = 6 // [X]
-	TypeLStat         = 7
-	TypeFStat         = 8
-	TypeSetStat       = 9
-	TypeFSetStat      = 10
-	TypeOpenDir       = 11 // [X]
-	TypeReadDir       = 12 // [X]
-	TypeRemove        = 13 // [X]
-	TypeMkDir         = 14 // [X]
-	TypeRmDir         = 15 // [X]
-	TypeRealPath      = 16
-	TypeStat          = 17
-	TypeRename        = 18 // [X]
-	TypeReadlink      = 19
-	TypeSymlink       = 20
+	TypeInit          = 1   // [X]
+	TypeVersion       = 2   // [X]
+	TypeOpen          = 3   // [X]
+	TypeClose         = 4   // [X]
+	TypeRead          = 5   // [X]
+	TypeWrite         = 6   // [X]
+	TypeLStat         = 7   // [X]
+	TypeFStat         = 8   // [X]
+	TypeSetStat       = 9   // [X]
+	TypeFSetStat      = 10  // [X]
+	TypeOpenDir       = 11  // [X]
+	TypeReadDir       = 12  // [X]
+	TypeRemove        = 13  // [X]
+	TypeMkDir         = 14  // [X]
+	TypeRmDir         = 15  // [X]
+	TypeRealPath      = 16  // [X]
+	TypeStat          = 17  // [X]
+	TypeRename        = 18  // [X]
+	TypeReadlink      = 19  // [X]
+	TypeSymlink       = 20  // [X]
 	TypeStatus        = 101 // [X]
 	TypeHandle        = 102 // [X]
 	TypeData          = 103 // [X]
-	TypeName          = 104
-	TypeAttr          = 105
-	TypeExtended      = 200
-	TypeExtendedReply = 201
+	TypeName          = 104 // [X]
+	TypeAttr          = 105 // [X]
+	TypeExtended      = 200 // [X]
+	TypeExtendedReply = 201 // [X]
 )
 
 // Writer wraps sshfxp messages that can be encoded into a binary form
@@ -48,7 +48,8 @@ type Reader interface {
 	Read(io.Reader) error
 }
 
-// TypeID returns the packet type ID based on the given interface x
+// TypeID returns the packet type ID based on the given interface x or 0 if x
+// is not a known message
 func TypeID(x interface{}) byte {
 	switch x.(type) {
 	case *Init:
@@ -99,10 +100,15 @@ func TypeID(x interface{}) byte {
 		return TypeData
 	case *Name:
 		return TypeName
+	case *Attrs:
+		return TypeAttr
+	case *Extended:
+		return TypeExtended
+	case *ExtendedReply:
+		return TypeExtendedReply
 	default:
-		panic(fmt.Sprintf("unknown type: %v", x))
+		return 0
 	}
-	return 0
 }
 
 // Packet wraps SSH FXP packets as defined within the RFC for SFTP version 3
@@ -119,6 +125,12 @@ type Packet struct {
 
 // Read reads packet contents from r
 func (p *Packet) Read(r io.Reader) error {
+	return p.ReadLimit(r, 0)
+}
+
+// ReadLimit is like Read but fails before reading the payload if the packet
+// is longer than max bytes. A zero max does not limit the packet length
+func (p *Packet) ReadLimit(r io.Reader, max uint32) error {
 	read := func(x interface{}) error {
 		return binary.Read(r, binary.BigEndian, x)
 	}
@@ -127,6 +139,14 @@ func (p *Packet) Read(r io.Reader) error {
 		return err
 	}
 
+	if p.Length == 0 {
+		return fmt.Errorf("invalid packet length: %d", p.Length)
+	}
+
+	if max > 0 && p.Length > max {
+		return fmt.Errorf("packet length %d exceeds limit of %d bytes", p.Length, max)
+	}
+
 	if err := read(&p.Type); err != nil {
 		return err
 	}
@@ -175,6 +195,11 @@ func (p *Packet) Encode(x interface{}) error {
 		}
 	}
 
+	typeID := TypeID(x)
+	if typeID == 0 {
+		return fmt.Errorf("invalid parameter: unknown message type %T", x)
+	}
+
 	if writer, ok := x.(Writer); !ok {
 		return fmt.Errorf("invalid parameter: %#v does not implement sshfxp.Writer", x)
 	} else {
@@ -186,7 +211,7 @@ func (p *Packet) Encode(x interface{}) error {
 	data := buf.Bytes()
 	p.Length = uint32(len(data) + 1)
 	p.Payload = data
-	p.Type = TypeID(x)
+	p.Type = typeID
 
 	return nil
 }
@@ -248,13 +273,11 @@ func (p *Packet) Decode() (Message, error) {
 	case TypeAttr:
 		o = &Attrs{}
 	case TypeExtended:
-		// TODO
-		return nil, fmt.Errorf("not yet implemented")
+		o = &Extended{}
 	case TypeExtendedReply:
-		// TODO
-		return nil, fmt.Errorf("not yet implemented")
+		o = &ExtendedReply{}
 	default:
-		return nil, fmt.Errorf("not yet implemented")
+		return nil, fmt.Errorf("unknown packet type %d", p.Type)
 	}
 
 	if int(p.Length) != len(p.Payload)+1 /* byte for type */ {
@@ -300,13 +323,20 @@ type Init struct {
 
 // Write implements Writer and marshals Init into its binary representation
 func (i *Init) Write(w io.Writer) error {
-	return binary.Write(w, binary.BigEndian, i.Version)
-	// TODO: write extensions
+	if err := binary.Write(w, binary.BigEndian, i.Version); err != nil {
+		return err
+	}
+
+	return writeExtensions(w, i.Extensions)
 }
 
 // Read implements Reader and unmarshals Init from its binary representation
 func (i *Init) Read(r io.Reader) error {
-	return binary.Read(r, binary.BigEndian, &i.Version)
+	if err := binary.Read(r, binary.BigEndian, &i.Version); err != nil {
+		return err
+	}
+
+	return readExtensions(r, &i.Extensions)
 }
 
 const (
@@ -383,11 +413,11 @@ func (a *Attr) Write(w io.Writer) error {
 		}
 
 		for _, e := range a.Extended {
-			if err := write(e.Type); err != nil {
+			if err := writeString(w, e.Type); err != nil {
 				return err
 			}
 
-			if err := write(e.Data); err != nil {
+			if err := writeString(w, e.Data); err != nil {
 				return err
 			}
 		}
@@ -636,13 +666,13 @@ func (_w *Write) Write(w io.Writer) error {
 	return writeString(w, _w.Data)
 }
 
-func (_w Write) Read(r io.Reader) error {
+func (_w *Write) Read(r io.Reader) error {
 	if err := readString(r, &_w.Handle); err != nil {
 		return err
 	}
 
 	if err := binary.Read(r, binary.BigEndian, &_w.Offset); err != nil {
-		return nil
+		return err
 	}
 
 	return readString(r, &_w.Data)
@@ -801,7 +831,7 @@ func (o *ReadDir) Read(r io.Reader) error {
 type Stat struct {
 	ID uint32
 
-	Handle string
+	Path string
 }
 
 func (x *Stat) SetID(id uint32) {
@@ -813,17 +843,17 @@ func (x *Stat) GetID() uint32 {
 }
 
 func (s *Stat) Write(w io.Writer) error {
-	return writeString(w, s.Handle)
+	return writeString(w, s.Path)
 }
 
 func (s *Stat) Read(r io.Reader) error {
-	return readString(r, &s.Handle)
+	return readString(r, &s.Path)
 }
 
 type LStat struct {
 	ID uint32
 
-	Handle string
+	Path string
 }
 
 func (x *LStat) SetID(id uint32) {
@@ -835,11 +865,11 @@ func (x *LStat) GetID() uint32 {
 }
 
 func (s *LStat) Write(w io.Writer) error {
-	return writeString(w, s.Handle)
+	return writeString(w, s.Path)
 }
 
 func (s *LStat) Read(r io.Reader) error {
-	return readString(r, &s.Handle)
+	return readString(r, &s.Path)
 }
 
 type FStat struct {
@@ -898,8 +928,8 @@ func (ss *SetStat) Read(r io.Reader) error {
 type FSetStat struct {
 	ID uint32
 
-	Path string
-	Attr Attr
+	Handle string
+	Attr   Attr
 }
 
 func (x *FSetStat) SetID(id uint32) {
@@ -911,7 +941,7 @@ func (x *FSetStat) GetID() uint32 {
 }
 
 func (ss *FSetStat) Write(w io.Writer) error {
-	if err := writeString(w, ss.Path); err != nil {
+	if err := writeString(w, ss.Handle); err != nil {
 		return err
 	}
 
@@ -919,7 +949,7 @@ func (ss *FSetStat) Write(w io.Writer) error {
 }
 
 func (ss *FSetStat) Read(r io.Reader) error {
-	if err := readString(r, &ss.Path); err != nil {
+	if err := readString(r, &ss.Handle); err != nil {
 		return err
 	}
 
@@ -1141,7 +1171,7 @@ func (n *Name) Write(w io.Writer) error {
 		}
 	}
 
-	return fmt.Errorf("Not yet implemented")
+	return nil
 }
 
 func (n *Name) Read(r io.Reader) error {
@@ -1178,6 +1208,14 @@ type Attrs struct {
 	Attr Attr
 }
 
+func (a *Attrs) SetID(id uint32) {
+	a.ID = id
+}
+
+func (a *Attrs) GetID() uint32 {
+	return a.ID
+}
+
 func (a *Attrs) Write(w io.Writer) error {
 	return a.Attr.Write(w)
 }
@@ -1195,18 +1233,76 @@ type Version struct {
 }
 
 func (v *Version) Write(w io.Writer) error {
-	return binary.Write(w, binary.BigEndian, v.Version)
-	// TODO: write extensions
+	if err := binary.Write(w, binary.BigEndian, v.Version); err != nil {
+		return err
+	}
+
+	return writeExtensions(w, v.Extensions)
 }
 
 func (v *Version) Read(r io.Reader) error {
-	return binary.Read(r, binary.BigEndian, &v.Version)
+	if err := binary.Read(r, binary.BigEndian, &v.Version); err != nil {
+		return err
+	}
+
+	return readExtensions(r, &v.Extensions)
 }
 
 //
 // internals and helper functions
 //
 
+// writeExtensions writes the extension-pairs of SSH_FXP_INIT and
+// SSH_FXP_VERSION packets
+func writeExtensions(w io.Writer, extensions []struct {
+	Name string
+	Data string
+}) error {
+	for _, ext := range extensions {
+		if err := writeString(w, ext.Name); err != nil {
+			return err
+		}
+
+		if err := writeString(w, ext.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readExtensions reads extension-pairs until the end of r. They fill the rest
+// of SSH_FXP_INIT and SSH_FXP_VERSION packets
+func readExtensions(r io.Reader, extensions *[]struct {
+	Name string
+	Data string
+}) error {
+	for {
+		var name, data string
+
+		if err := readString(r, &name); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		if err := readString(r, &data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return err
+		}
+
+		*extensions = append(*extensions, struct {
+			Name string
+			Data string
+		}{name, data})
+	}
+}
+
 func readString(r io.Reader, v *string) error {
 	var length uint32
 
@@ -1214,12 +1310,21 @@ func readString(r io.Reader, v *string) error {
 		return err
 	}
 
-	buf := make([]byte, length)
-	if err := binary.Read(r, binary.BigEndian, &buf); err != nil {
+	// the length is taken from the wire and must not exceed the data left
+	if l, ok := r.(interface{ Len() int }); ok && uint64(length) > uint64(l.Len()) {
+		return fmt.Errorf("string length %d exceeds remaining %d bytes", length, l.Len())
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
 		return err
 	}
 
-	*v = string(buf)
+	*v = buf.String()
 
 	return nil
 }
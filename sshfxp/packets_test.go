@@ -0,0 +1,71 @@
+package sshfxp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// roundTrip encodes x into a packet, marshals and reads it back and returns
+// the decoded message
+func roundTrip(t *testing.T, x Message) Message {
+	t.Helper()
+
+	var pkt Packet
+	if err := pkt.Encode(x); err != nil {
+		t.Fatalf("Encode(%T): %s", x, err)
+	}
+
+	data, err := pkt.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes(%T): %s", x, err)
+	}
+
+	var read Packet
+	if err := read.Read(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Read(%T): %s", x, err)
+	}
+
+	msg, err := read.Decode()
+	if err != nil {
+		t.Fatalf("Decode(%T): %s", x, err)
+	}
+
+	return msg
+}
+
+type extensionPairs = []struct {
+	Name string
+	Data string
+}
+
+func TestInitVersionExtensions(t *testing.T) {
+	pairs := extensionPairs{
+		{"posix-rename@openssh.com", "1"},
+		{"statvfs@openssh.com", "2"},
+		{"empty@example.com", ""},
+	}
+
+	tests := []Message{
+		&Init{Version: 3},
+		&Init{Version: 3, Extensions: pairs},
+		&Version{Version: 3},
+		&Version{Version: 3, Extensions: pairs},
+	}
+
+	for _, x := range tests {
+		if msg := roundTrip(t, x); !reflect.DeepEqual(msg, x) {
+			t.Errorf("decoded %#v, expected %#v", msg, x)
+		}
+	}
+}
+
+func TestVersionTruncatedExtension(t *testing.T) {
+	// an extension name without data
+	payload := []byte{0, 0, 0, 3, 0, 0, 0, 3, 'f', 'o', 'o'}
+
+	pkt := Packet{Length: uint32(len(payload) + 1), Type: TypeVersion, Payload: payload}
+	if _, err := pkt.Decode(); err == nil {
+		t.Error("decoded a version with an extension name missing its data")
+	}
+}
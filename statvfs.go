@@ -0,0 +1,23 @@
+package sftp
+
+import "github.com/nethack42/go-sftp/sshfxp"
+
+// StatVFS holds file system statistics as returned by the statvfs@openssh.com
+// and fstatvfs@openssh.com extensions. Block counts are in units of
+// FragmentSize
+type StatVFS sshfxp.StatVFS
+
+// TotalSpace returns the size of the file system in bytes
+func (st *StatVFS) TotalSpace() uint64 {
+	return st.Blocks * st.FragmentSize
+}
+
+// FreeSpace returns the number of bytes available to unprivileged users
+func (st *StatVFS) FreeSpace() uint64 {
+	return st.BlocksAvail * st.FragmentSize
+}
+
+// IsReadOnly returns true if the file system is mounted read-only
+func (st *StatVFS) IsReadOnly() bool {
+	return st.Flag&sshfxp.StatVFSReadOnly != 0
+}
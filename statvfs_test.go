@@ -0,0 +1,132 @@
+package sftp
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/nethack42/go-sftp/sshfxp"
+)
+
+// statVFSHandler reports st for all existing paths and file handles
+type statVFSHandler struct {
+	*MemoryHandler
+
+	st StatVFS
+}
+
+func (h *statVFSHandler) StatVFS(p string) (*StatVFS, error) {
+	if _, err := h.Stat(p); err != nil {
+		return nil, err
+	}
+
+	st := h.st
+	return &st, nil
+}
+
+func (h *statVFSHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	f, err := h.MemoryHandler.Open(p, flag, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statVFSFile{f, h.st}, nil
+}
+
+type statVFSFile struct {
+	FileHandle
+
+	st StatVFS
+}
+
+func (f *statVFSFile) StatVFS() (*StatVFS, error) {
+	st := f.st
+	return &st, nil
+}
+
+func TestStatVFS(t *testing.T) {
+	h := &statVFSHandler{
+		MemoryHandler: NewMemoryHandler(),
+		st: StatVFS{
+			BlockSize:    4096,
+			FragmentSize: 1024,
+			Blocks:       1000,
+			BlocksFree:   600,
+			BlocksAvail:  500,
+			Files:        100,
+			FilesFree:    50,
+			FilesAvail:   50,
+			Flag:         sshfxp.StatVFSReadOnly,
+			NameMax:      255,
+		},
+	}
+
+	cli := newServerClient(t, h)
+
+	st, err := cli.StatVFS("/")
+	if err != nil {
+		t.Fatalf("StatVFS: %s", err)
+	}
+
+	if *st != h.st {
+		t.Errorf("StatVFS returned %+v, expected %+v", *st, h.st)
+	}
+
+	if st.TotalSpace() != 1000*1024 || st.FreeSpace() != 500*1024 || !st.IsReadOnly() {
+		t.Errorf("StatVFS reports %d bytes total, %d bytes free, read-only %t", st.TotalSpace(), st.FreeSpace(), st.IsReadOnly())
+	}
+
+	_, err = cli.StatVFS("/missing")
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusNoSuchFile {
+		t.Errorf("StatVFS of a missing path returned %v, expected SSH_FX_NO_SUCH_FILE", err)
+	}
+
+	f, err := cli.OpenFile("/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	if st, err := f.StatVFS(); err != nil || *st != h.st {
+		t.Errorf("File.StatVFS returned %+v, %v", st, err)
+	}
+
+	// MemoryHandler directory handles do not implement StatVFSHandle
+	if err := cli.MkDir("/dir", nil); err != nil {
+		t.Fatalf("MkDir: %s", err)
+	}
+
+	handle, err := cli.OpenDir("/dir")
+	if err != nil {
+		t.Fatalf("OpenDir: %s", err)
+	}
+	defer cli.CloseHandle(handle)
+
+	_, err = cli.FStatVFS(handle)
+	if code, _ := statusCodeOf(err); code != sshfxp.StatusOpUnsupported {
+		t.Errorf("FStatVFS of a directory handle returned %v, expected SSH_FX_OP_UNSUPPORTED", err)
+	}
+
+	if _, err := cli.FStatVFS("no-such-handle"); err == nil {
+		t.Error("FStatVFS of an unknown handle succeeded")
+	}
+}
+
+func TestStatVFSUnsupported(t *testing.T) {
+	cli := newServerClient(t, NewMemoryHandler())
+
+	_, err := cli.StatVFS("/")
+
+	var unsupported *ExtensionUnsupportedError
+	if !errors.As(err, &unsupported) || unsupported.Name != sshfxp.ExtStatVFS {
+		t.Errorf("StatVFS returned %v, expected an *ExtensionUnsupportedError", err)
+	}
+
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("StatVFS returned %v not matching ErrUnsupported", err)
+	}
+
+	if _, err := cli.FStatVFS("handle"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("FStatVFS returned %v, expected ErrUnsupported", err)
+	}
+}
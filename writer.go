@@ -4,67 +4,177 @@ import (
 	"io"
 	"sync"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/nethack42/go-sftp/sshfxp"
 )
 
 type FileWriter struct {
-	io.WriteCloser
-
 	cli    ClientConn
 	handle string
 
-	pipe_read io.ReadCloser
+	chunkSize   int
+	concurrency int
+
+	pipe_read  *io.PipeReader
+	pipe_write *io.PipeWriter
+
+	err error
 
 	wg sync.WaitGroup
 }
 
-func (fw *FileWriter) write() {
-	defer fw.wg.Done()
-	defer fw.cli.Close(fw.handle)
-	defer fw.pipe_read.Close()
+// Write queues p for being written to the remote file. Once a write request
+// failed, Write returns the error of the failed request
+func (fw *FileWriter) Write(p []byte) (int, error) {
+	return fw.pipe_write.Write(p)
+}
 
-	offset := uint64(0)
-	for {
-		p := make([]byte, 1024)
+// Close waits for all pending write requests to finish, closes the remote
+// file and returns the first error encountered
+func (fw *FileWriter) Close() error {
+	fw.pipe_write.Close()
+	fw.wg.Wait()
 
-		n, err := fw.pipe_read.Read(p)
+	return fw.err
+}
 
-		if n > 0 {
-			if err := fw.cli.Write(fw.handle, offset, p[:n]); err != nil {
-				if e, ok := err.(*sshfxp.FxpStatusError); ok && e.Code == sshfxp.StatusEOF {
-					break
-				}
-				logrus.Errorf("failed to write: %s", err)
-				break
-			}
-			// write file
-			offset += uint64(n)
-		}
+func (fw *FileWriter) write() {
+	defer fw.wg.Done()
 
-		if err != nil {
-			break
-		}
+	_, err := writeBehind(fw.cli, fw.handle, 0, fw.chunkSize, fw.concurrency, fw.pipe_read)
+	if err != nil {
+		// make sure further calls to Write fail as well
+		fw.pipe_read.CloseWithError(err)
+	}
+
+	if cerr := fw.cli.CloseHandle(fw.handle); err == nil {
+		err = cerr
 	}
+
+	fw.err = err
 }
 
+// NewFileWriter creates or truncates the file identified by path and returns
+// an io.WriteCloser that writes to it using DefaultChunkSize and
+// DefaultConcurrency
 func NewFileWriter(path string, cli ClientConn) (*FileWriter, error) {
-	handle, err := cli.Open(path, sshfxp.OpenCreate|sshfxp.OpenWrite, nil)
+	return NewFileWriterSize(path, cli, DefaultChunkSize, DefaultConcurrency)
+}
+
+// NewFileWriterSize creates or truncates the file identified by path and
+// returns an io.WriteCloser that writes to it in chunks of chunkSize bytes
+// while keeping up to concurrency write requests in flight
+func NewFileWriterSize(path string, cli ClientConn, chunkSize, concurrency int) (*FileWriter, error) {
+	handle, err := cli.Open(path, sshfxp.OpenCreate|sshfxp.OpenWrite|sshfxp.OpenTruncate, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	pipe_read, pipe_write := io.Pipe()
-
 	writer := &FileWriter{
-		WriteCloser: pipe_write,
-		pipe_read:   pipe_read,
 		cli:         cli,
 		handle:      handle,
+		chunkSize:   chunkSize,
+		concurrency: concurrency,
 	}
 
+	writer.pipe_read, writer.pipe_write = io.Pipe()
+
 	writer.wg.Add(1)
 	go writer.write()
 
 	return writer, nil
 }
+
+type writeResult struct {
+	chunk int
+	err   error
+}
+
+// writeBehind reads r until EOF and writes the data to the file identified by
+// handle starting at offset. The data is sent in chunks of chunkSize bytes and
+// up to concurrency write requests are kept in flight. writeBehind stops at the
+// first failed request and returns its error together with the number of bytes
+// at the start of the data that have been acknowledged without a gap. Chunks
+// acknowledged after a failed one are not counted
+func writeBehind(cli ClientConn, handle string, offset uint64, chunkSize, concurrency int, r io.Reader) (int64, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		results  = make(chan writeResult, concurrency)
+		inflight int
+		written  int64
+		firstErr error
+
+		// sizes holds the length of sent chunks not yet counted in
+		// written, acked those of them acknowledged out of order.
+		// frontier is the index of the first chunk not counted
+		sizes    = make(map[int]int)
+		acked    = make(map[int]bool)
+		frontier int
+		next     int
+	)
+
+	collect := func() {
+		res := <-results
+		inflight--
+
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			return
+		}
+
+		acked[res.chunk] = true
+		for acked[frontier] {
+			written += int64(sizes[frontier])
+			delete(acked, frontier)
+			delete(sizes, frontier)
+			frontier++
+		}
+	}
+
+	for firstErr == nil {
+		buf := make([]byte, chunkSize)
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if inflight == concurrency {
+				collect()
+
+				if firstErr != nil {
+					break
+				}
+			}
+
+			sizes[next] = n
+
+			inflight++
+			go func(chunk int, offset uint64, data []byte) {
+				results <- writeResult{chunk, cli.Write(handle, offset, data)}
+			}(next, offset, buf[:n])
+
+			next++
+			offset += uint64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			firstErr = err
+		}
+	}
+
+	for inflight > 0 {
+		collect()
+	}
+
+	return written, firstErr
+}
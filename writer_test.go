@@ -0,0 +1,65 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+// failingHandler fails all writes to failOffset
+type failingHandler struct {
+	*MemoryHandler
+
+	failOffset int64
+}
+
+func (h *failingHandler) Open(p string, flag int, attr FileAttr) (FileHandle, error) {
+	f, err := h.MemoryHandler.Open(p, flag, attr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &failingFile{f, h.failOffset}, nil
+}
+
+type failingFile struct {
+	FileHandle
+
+	failOffset int64
+}
+
+func (f *failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if off == f.failOffset {
+		return 0, errors.New("write failed")
+	}
+
+	return f.FileHandle.WriteAt(p, off)
+}
+
+func TestWriteBehindContiguous(t *testing.T) {
+	const chunkSize = 1024
+
+	cli, err := NewLoopbackClient(&failingHandler{NewMemoryHandler(), 2 * chunkSize})
+	if err != nil {
+		t.Fatalf("NewLoopbackClient: %s", err)
+	}
+	defer cli.Close()
+
+	f, err := cli.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %s", err)
+	}
+	defer f.Close()
+
+	data := bytes.Repeat([]byte("x"), 16*chunkSize)
+
+	n, err := writeBehind(cli, f.Handle(), 0, chunkSize, 8, bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("writeBehind did not report the failed chunk")
+	}
+
+	if n != 2*chunkSize {
+		t.Errorf("writeBehind reported %d bytes, expected the %d bytes before the failed chunk", n, 2*chunkSize)
+	}
+}